@@ -63,10 +63,13 @@ type Config struct {
 			Proxy    int `long:"redis-db-proxy" env:"REDIS_DB_PROXY" default:"3" description:""`
 		}
 		Channel struct {
-			User     string `long:"redis-ch-user" env:"REDIS_CH_USER" default:"user" description:""`
-			Data     string `long:"redis-ch-data" env:"REDIS_CH_DATA" default:"data" description:""`
-			Activity string `long:"redis-ch-activity" env:"REDIS_CH_ACTIVITY" default:"activity" description:""`
-			Restart  string `long:"redis-ch-restart" env:"REDIS_CH_RESTART" default:"restart" description:""`
+			User      string `long:"redis-ch-user" env:"REDIS_CH_USER" default:"user" description:""`
+			Data      string `long:"redis-ch-data" env:"REDIS_CH_DATA" default:"data" description:""`
+			Activity  string `long:"redis-ch-activity" env:"REDIS_CH_ACTIVITY" default:"activity" description:""`
+			Restart   string `long:"redis-ch-restart" env:"REDIS_CH_RESTART" default:"restart" description:""`
+			Health    string `long:"redis-ch-health" env:"REDIS_CH_HEALTH" default:"health" description:""`
+			Blocklist string `long:"redis-ch-blocklist" env:"REDIS_CH_BLOCKLIST" default:"blocklist" description:"blocklist change notifications"`
+			Proxy     string `long:"redis-ch-proxy" env:"REDIS_CH_PROXY" default:"proxy" description:"proxy record upsert and delete events"`
 		}
 	}
 
@@ -90,50 +93,71 @@ type Config struct {
 
 	Proxy struct {
 		PortHTTP     int           `long:"proxy-port-http" env:"PROXY_PORT_HTTP" default:"8080" description:""`
+		PortSOCKS5   int           `long:"proxy-port-socks5" env:"PROXY_PORT_SOCKS5" default:"1080" description:""`
 		BufferSize   int           `long:"proxy-buffer-size" env:"PROXY_BUFFER_SIZE" default:"4096" description:""`
 		ReadDeadline time.Duration `long:"proxy-read-deadline" env:"PROXY_READ_DEADLINE" default:"30s" description:""`
 		DialTimeout  time.Duration `long:"proxy-dial-timeout" env:"PROXY_DIAL_TIMEOUT" default:"10s" description:""`
 	}
 
+	Retry struct {
+		MaxAttempts int           `long:"retry-max-attempts" env:"RETRY_MAX_ATTEMPTS" default:"3" description:"upstream attempts per request including the first one"`
+		Budget      time.Duration `long:"retry-budget" env:"RETRY_BUDGET" default:"20s" description:"no new attempt is started after this time"`
+		Methods     string        `long:"retry-methods" env:"RETRY_METHODS" default:"GET,HEAD,OPTIONS,TRACE,PUT,DELETE" description:"plain HTTP methods safe to replay"`
+	}
+
+	Reseller struct {
+		Templates  string        `long:"reseller-templates" env:"RESELLER_TEMPLATES" description:"JSON file of reseller username templates added to the built in ones"`
+		Key        string        `long:"reseller-templates-key" env:"RESELLER_TEMPLATES_KEY" default:"reseller_templates" description:"redis hash of reseller name to JSON username template"`
+		SyncPeriod time.Duration `long:"reseller-templates-sync-period" env:"RESELLER_TEMPLATES_SYNC_PERIOD" default:"1m" description:""`
+	}
+
+	Blocklist struct {
+		Prefix     string        `long:"blocklist-prefix" env:"BLOCKLIST_PREFIX" default:"blocklist:" description:"prefix of the blocklist redis sets"`
+		SyncPeriod time.Duration `long:"blocklist-sync-period" env:"BLOCKLIST_SYNC_PERIOD" default:"1m" description:""`
+	}
+
+	Policy struct {
+		DeniedPorts   string        `long:"policy-denied-ports" env:"POLICY_DENIED_PORTS" default:"25,465,587" description:"destination ports denied to every purchase"`
+		AllowedPorts  string        `long:"policy-allowed-ports" env:"POLICY_ALLOWED_PORTS" default:"" description:"allowed port ranges per purchase type, e.g. static:1-65535;provider:80,443"`
+		LookupTimeout time.Duration `long:"policy-lookup-timeout" env:"POLICY_LOOKUP_TIMEOUT" default:"2s" description:"destination DNS lookup timeout"`
+		LookupCache   int           `long:"policy-lookup-cache" env:"POLICY_LOOKUP_CACHE" default:"10000" description:"destination lookups cached by host"`
+		LookupTTL     time.Duration `long:"policy-lookup-ttl" env:"POLICY_LOOKUP_TTL" default:"1m" description:"how long a resolved destination is cached"`
+		LookupNegTTL  time.Duration `long:"policy-lookup-negative-ttl" env:"POLICY_LOOKUP_NEGATIVE_TTL" default:"10s" description:"how long a failed destination lookup is cached"`
+		LookupFailure string        `long:"policy-lookup-failure" env:"POLICY_LOOKUP_FAILURE" default:"open" choice:"open" choice:"closed" description:"allow destinations which can not be resolved, leaving them to the upstream, or deny them"`
+	}
+
+	RateLimit struct {
+		Mode      string `long:"rate-limit-mode" env:"RATE_LIMIT_MODE" default:"local" choice:"local" choice:"redis" description:"local buckets per instance or redis buckets shared by all instances"`
+		CacheSize int    `long:"rate-limit-cache-size" env:"RATE_LIMIT_CACHE_SIZE" default:"10000" description:"local buckets kept"`
+		Prefix    string `long:"rate-limit-prefix" env:"RATE_LIMIT_PREFIX" default:"ratelimit:" description:"prefix of the redis buckets"`
+	}
+
+	Tracker struct {
+		Mode   string        `long:"tracker-mode" env:"TRACKER_MODE" default:"local" choice:"local" choice:"redis" description:"threads counted per instance or across all instances in redis"`
+		Prefix string        `long:"tracker-prefix" env:"TRACKER_PREFIX" default:"threads:" description:"prefix of the redis thread counters"`
+		Node   string        `long:"tracker-node" env:"TRACKER_NODE" description:"instance name in redis, hostname and pid when empty"`
+		Lease  time.Duration `long:"tracker-lease" env:"TRACKER_LEASE" default:"30s" description:"time the threads of an unresponsive instance are kept"`
+	}
+
+	Health struct {
+		FailureThreshold int           `long:"health-failure-threshold" env:"HEALTH_FAILURE_THRESHOLD" default:"5" description:"consecutive failures opening a provider circuit"`
+		OpenTimeout      time.Duration `long:"health-open-timeout" env:"HEALTH_OPEN_TIMEOUT" default:"30s" description:"time before an open circuit lets a trial attempt through"`
+		ProbeTarget      string        `long:"health-probe-target" env:"HEALTH_PROBE_TARGET" default:"" description:"host:port connected through every provider, empty disables probing"`
+		ProbePeriod      time.Duration `long:"health-probe-period" env:"HEALTH_PROBE_PERIOD" default:"30s" description:""`
+		PublishPeriod    time.Duration `long:"health-publish-period" env:"HEALTH_PUBLISH_PERIOD" default:"10s" description:""`
+	}
+
+	Transport struct {
+		CacheSize           int           `long:"transport-cache-size" env:"TRANSPORT_CACHE_SIZE" default:"1000" description:""`
+		MaxIdleConnsPerHost int           `long:"transport-max-idle-conns-per-host" env:"TRANSPORT_MAX_IDLE_CONNS_PER_HOST" default:"16" description:""`
+		IdleConnTimeout     time.Duration `long:"transport-idle-conn-timeout" env:"TRANSPORT_IDLE_CONN_TIMEOUT" default:"90s" description:""`
+		StatsPeriod         time.Duration `long:"transport-stats-period" env:"TRANSPORT_STATS_PERIOD" default:"1m" description:""`
+	}
+
 	Provider struct {
 		Static struct {
 			SyncPeriod time.Duration `long:"provider-sync-period" env:"PROVIDER_SYNC_PERIOD" default:"1m"`
 		}
-
-		TTProxy struct {
-			BaseURL          string `long:"provider-ttp-base-url" env:"PROVIDER_TTP_BASEURL" default:"https://api.ttproxy.com/v1/subLicense/"`
-			License          string `long:"provider-ttp-license" env:"PROVIDER_TTP_LICENSE"`
-			Secret           string `long:"provider-ttp-secret" env:"PROVIDER_TTP_SECRET"`
-			ProxyCredentials struct {
-				Host string `long:"provider-ttp-proxy-cred-host" env:"PROVIDER_TTP_PROXY_CRED_HOST" default:"dynamic.ttproxy.com"`
-				Port int    `long:"provider-ttp-proxy-cred-port" env:"PROVIDER_TTP_PROXY_CRED_PORT" default:"10001"`
-			}
-		}
-		DataImpulse struct {
-			BaseURL          string `long:"provider-di-base-url" env:"PROVIDER_DI_BASEURL" default:"https://api.dataimpulse.com/provider/"`
-			Login            string `long:"provider-di-login" env:"PROVIDER_DI_LOGIN"`
-			Password         string `long:"provider-di-password" env:"PROVIDER_DI_PASSWORD"`
-			ProxyCredentials struct {
-				Host string `long:"provider-di-proxy-cred-host" env:"PROVIDER_DI_PROXY_CRED_HOST" default:"gw.dataimpulse.com"`
-				Port int    `long:"provider-di-proxy-cred-port" env:"PROVIDER_DI_PROXY_CRED_PORT" default:"823"`
-			}
-		}
-		Proxyverse struct {
-			ProxyCredentials struct {
-				Host     string `long:"provider-pv-proxy-cred-host" env:"PROVIDER_PV_PROXY_CRED_HOST" default:"51.81.93.42"`
-				Port     int    `long:"provider-pv-proxy-cred-port" env:"PROVIDER_PV_PROXY_CRED_PORT" default:"9200"`
-				Username string `long:"provider-pv-proxy-cred-username" env:"PROVIDER_PV_PROXY_CRED_USERNAME"`
-				Password string `long:"provider-pv-proxy-cred-password" env:"PROVIDER_PV_PROXY_CRED_PASSWORD"`
-			}
-		}
-		Databay struct {
-			ProxyCredentials struct {
-				Host     string `long:"provider-db-proxy-cred-host" env:"PROVIDER_DB_PROXY_CRED_HOST" default:"resi-global-gateways.databay.com"`
-				Port     int    `long:"provider-db-proxy-cred-port" env:"PROVIDER_DB_PROXY_CRED_PORT" default:"7676"`
-				Username string `long:"provider-db-proxy-cred-username" env:"PROVIDER_DB_PROXY_CRED_USERNAME"`
-				Password string `long:"provider-db-proxy-cred-password" env:"PROVIDER_DB_PROXY_CRED_PASSWORD"`
-			}
-		}
 	}
 
 	Sync struct {
@@ -153,11 +177,25 @@ type Config struct {
 	}
 
 	Accountant struct {
-		Bytes int64 `long:"accountant-bytes" env:"ACCOUNTANT_BYTES" default:"256000" description:""`
+		Bytes  int64  `long:"accountant-bytes" env:"ACCOUNTANT_BYTES" default:"256000" description:""`
+		Mode   string `long:"accountant-mode" env:"ACCOUNTANT_MODE" default:"pubsub" choice:"pubsub" choice:"stream" description:"usage published to the data channel or appended to a redis stream"`
+		Stream struct {
+			Name   string `long:"accountant-stream" env:"ACCOUNTANT_STREAM" default:"usage" description:"redis stream of usage batches"`
+			MaxLen int64  `long:"accountant-stream-max-len" env:"ACCOUNTANT_STREAM_MAX_LEN" default:"0" description:"approximate stream length kept, unlimited when 0"`
+			Spool  string `long:"accountant-stream-spool" env:"ACCOUNTANT_STREAM_SPOOL" default:"usage.spool" description:"file keeping usage batches while redis is unavailable"`
+		}
+	}
+
+	Ledger struct {
+		Reconcile time.Duration `long:"ledger-reconcile" env:"LEDGER_RECONCILE" default:"10s" description:"period the local data balances are reloaded from redis"`
 	}
 
 	Authorization struct {
 		CacheSize int           `long:"authorization-cache-size" env:"AUTHORIZATION_CACHE_SIZE" default:"1000" description:""`
 		TTL       time.Duration `long:"authorization-ttl" env:"AUTHORIZATION_TTL" default:"5m" description:""`
+		Allowlist struct {
+			Key  string        `long:"authorization-allowlist-key" env:"AUTHORIZATION_ALLOWLIST_KEY" default:"allowlist" description:"set of the purchase passwords with allowed_ips, in the purchase database"`
+			Sync time.Duration `long:"authorization-allowlist-sync" env:"AUTHORIZATION_ALLOWLIST_SYNC" default:"1m" description:"full reload of the allowed networks of the indexed purchases"`
+		}
 	}
 }
@@ -2,11 +2,13 @@ module github.com/omimic12/proxy-server
 
 go 1.22.0
 
-require github.com/joho/godotenv v1.5.1
+require (
+	github.com/influxdata/influxdb-client-go/v2 v2.14.0
+	github.com/joho/godotenv v1.5.1
+)
 
 require (
 	github.com/apapsch/go-jsonmerge/v2 v2.0.0 // indirect
-	github.com/influxdata/influxdb-client-go/v2 v2.14.0 // indirect
 	github.com/influxdata/line-protocol v0.0.0-20200327222509-2487e7298839 // indirect
 	github.com/oapi-codegen/runtime v1.0.0 // indirect
 	github.com/tidwall/match v1.1.1 // indirect
@@ -20,7 +22,7 @@ require (
 
 require (
 	github.com/bluele/gcache v0.0.2
-	github.com/cespare/xxhash/v2 v2.1.2 // indirect
+	github.com/cespare/xxhash/v2 v2.1.2
 	github.com/detailyang/domaintree-go v0.0.0-20191120072826-cf715de32572
 	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
 	github.com/go-redis/redis/v8 v8.11.5
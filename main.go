@@ -9,6 +9,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"time"
 
 	"github.com/go-redis/redis/v8"
@@ -19,11 +20,18 @@ import (
 	"github.com/omimic12/proxy-server/pkg"
 	"github.com/omimic12/proxy-server/pkg/accountant"
 	"github.com/omimic12/proxy-server/pkg/auth"
+	"github.com/omimic12/proxy-server/pkg/blocklist"
+	"github.com/omimic12/proxy-server/pkg/health"
+	"github.com/omimic12/proxy-server/pkg/ledger"
 	"github.com/omimic12/proxy-server/pkg/measure"
+	"github.com/omimic12/proxy-server/pkg/policy"
+	"github.com/omimic12/proxy-server/pkg/provider"
+	"github.com/omimic12/proxy-server/pkg/ratelimit"
 	"github.com/omimic12/proxy-server/pkg/router"
 	"github.com/omimic12/proxy-server/pkg/sessions"
 	"github.com/omimic12/proxy-server/pkg/settings"
 	"github.com/omimic12/proxy-server/pkg/tracker"
+	"github.com/omimic12/proxy-server/pkg/transport"
 	"github.com/omimic12/proxy-server/pkg/username"
 	"github.com/pariz/gountries"
 	"go.uber.org/zap"
@@ -98,12 +106,6 @@ func main() {
 		logger.Panic("failed to ping redis proxy database", zap.Error(err))
 	}
 
-	const dataChBufferSize = 500
-	dataAccountant, err := accountant.NewRedis(ctx, dataChBufferSize, cfg.Redis.Channel.Data, redisData, cfg.Sync.Data, logger)
-	if err != nil {
-		panic(err)
-	}
-
 	influxDbUrl := fmt.Sprintf("http://%s:%d", cfg.InfluxDB.Host, cfg.InfluxDB.Port)
 	influxDbClient := influxdb2.NewClient(influxDbUrl, cfg.InfluxDB.Token)
 	perfMeasure, err := measure.NewInfluxDB(
@@ -120,11 +122,38 @@ func main() {
 		panic(err)
 	}
 
+	const dataMaxEntries = 100000
+	var dataAccountant pkg.Accountant
+	if cfg.Accountant.Mode == "stream" {
+		usageStream, err := accountant.NewStream(
+			ctx,
+			redisData,
+			cfg.Accountant.Stream.Name,
+			cfg.Accountant.Stream.MaxLen,
+			cfg.Accountant.Stream.Spool,
+			cfg.Sync.Data,
+			logger,
+		)
+		if err != nil {
+			panic(err)
+		}
+		defer usageStream.Close() //nolint:errcheck
+
+		dataAccountant = usageStream
+	} else {
+		dataAccountant, err = accountant.NewRedis(ctx, dataMaxEntries, cfg.Redis.Channel.Data, redisData, cfg.Sync.Data, perfMeasure, logger)
+		if err != nil {
+			panic(err)
+		}
+	}
+
 	a, err := auth.NewRedisGCache(
 		ctx,
 		cfg.Authorization.CacheSize,
 		cfg.Authorization.TTL,
 		cfg.Redis.Channel.User,
+		cfg.Authorization.Allowlist.Key,
+		cfg.Authorization.Allowlist.Sync,
 		redisData,
 		redisPurchase,
 		parser,
@@ -134,10 +163,51 @@ func main() {
 		panic(err)
 	}
 
+	blocklists, err := blocklist.NewRedis(ctx, redisData, cfg.Blocklist.Prefix, logger)
+	if err != nil {
+		panic(err)
+	}
+	go blocklists.Listen(ctx, cfg.Blocklist.SyncPeriod, cfg.Redis.Channel.Blocklist) //nolint:errcheck
+
+	ports, err := policy.NewPorts(
+		cfg.Policy.DeniedPorts,
+		cfg.Policy.AllowedPorts,
+		cfg.Policy.LookupTimeout,
+		cfg.Policy.LookupCache,
+		cfg.Policy.LookupTTL,
+		cfg.Policy.LookupNegTTL,
+		cfg.Policy.LookupFailure == "closed",
+		logger,
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	var limiter pkg.RateLimiter = ratelimit.NewLocal(cfg.RateLimit.CacheSize)
+	if cfg.RateLimit.Mode == "redis" {
+		limiter = ratelimit.NewRedis(redisData, cfg.RateLimit.Prefix)
+	}
+
+	balances := ledger.NewRedis(redisData, logger)
+	go balances.Reconcile(ctx, cfg.Ledger.Reconcile) //nolint:errcheck
+
 	providers := []pkg.Provider{}
 	fixedSettings := settings.NewFixed(providers)
 
+	breaker := health.NewBreaker(cfg.Health.FailureThreshold, cfg.Health.OpenTimeout, logger)
+
 	fetchTimeout := time.Second * 5
+	templates := provider.NewTemplates(logger)
+	if cfg.Reseller.Templates != "" {
+		if err = templates.LoadFile(cfg.Reseller.Templates); err != nil {
+			logger.Panic("failed to load reseller templates", zap.Error(err))
+		}
+	}
+	if err = templates.LoadRedis(ctx, redisData, cfg.Reseller.Key); err != nil {
+		logger.Error("failed to load reseller templates", zap.Error(err))
+	}
+	go templates.Listen(ctx, redisData, cfg.Reseller.Key, cfg.Reseller.SyncPeriod) //nolint:errcheck
+
 	rr, err := router.NewWeightedRoundRobin(
 		fixedSettings,
 		cfg.Proxy.DialTimeout,
@@ -145,16 +215,51 @@ func main() {
 		fetchTimeout,
 		cfg.Provider.Static.SyncPeriod,
 		redisProxy,
+		breaker,
+		templates,
 		logger,
 	)
 	if err != nil {
 		panic(err)
 	}
 
+	go rr.Listen(ctx, cfg.Redis.Channel.Proxy) //nolint:errcheck
+
+	rr.OnRemove(breaker.Forget)
+	if cfg.Health.ProbeTarget != "" {
+		go breaker.Probe(ctx, rr.Providers, cfg.Health.ProbeTarget, cfg.Health.ProbePeriod)
+	}
+	go func() {
+		err := breaker.Publish(ctx, cfg.Health.PublishPeriod, cfg.Redis.Channel.Health, redisData)
+		if err != nil && err != context.Canceled {
+			logger.Error("providers health publisher failed", zap.Error(err))
+		}
+	}()
+
+	transports := transport.NewCache(
+		cfg.Transport.CacheSize,
+		cfg.Proxy.DialTimeout,
+		cfg.Transport.MaxIdleConnsPerHost,
+		cfg.Transport.IdleConnTimeout,
+		logger,
+	)
+	defer transports.Close() //nolint:errcheck
+
+	rr.OnRemove(transports.Evict)
+	go transports.Report(ctx, cfg.Transport.StatsPeriod)
+
 	sessionStorage := sessions.NewGCache(cfg.Session.CacheSize, logger)
 	defer sessionStorage.Close() //nolint:errcheck
 
-	requestTracker := tracker.NewMap(redisData, logger)
+	var requestTracker interface {
+		pkg.ConnectionTracker
+		Listen(ctx context.Context, chUserInvalidate string) error
+	} = tracker.NewMap(redisData, logger)
+	if cfg.Tracker.Mode == "redis" {
+		clusterTracker := tracker.NewRedis(redisData, cfg.Tracker.Prefix, cfg.Tracker.Node, cfg.Tracker.Lease, logger)
+		go clusterTracker.Run(ctx) //nolint:errcheck
+		requestTracker = clusterTracker
+	}
 	defer requestTracker.Close() //nolint:errcheck
 
 	go requestTracker.Listen(ctx, cfg.Redis.Channel.User) //nolint:errcheck
@@ -174,7 +279,15 @@ func main() {
 		pkg.WithHTTPsServer(httpsServer),
 		pkg.WithAuth(a),
 		pkg.WithRouter(rr),
+		pkg.WithTransports(transports),
+		pkg.WithHealth(breaker),
+		pkg.WithBlocklist(blocklists),
+		pkg.WithPolicy(ports),
+		pkg.WithRateLimiter(limiter),
+		pkg.WithThrottle(ratelimit.NewBandwidth(cfg.RateLimit.CacheSize)),
+		pkg.WithRetryPolicy(pkg.NewRetryPolicy(cfg.Retry.MaxAttempts, cfg.Retry.Budget, strings.Split(cfg.Retry.Methods, ","))),
 		pkg.WithAccountant(dataAccountant),
+		pkg.WithLedger(balances),
 		pkg.WithMeasure(perfMeasure),
 		pkg.WithSessions(sessionStorage),
 		pkg.WithUsernameParser(parser),
@@ -223,6 +336,18 @@ func main() {
 		}()
 	}
 
+	if cfg.Proxy.PortSOCKS5 > 0 {
+		go func() {
+			logger.Info(fmt.Sprintf("Proxy: SOCKS5 Starting :%d", cfg.Proxy.PortSOCKS5))
+			defer logger.Info("Proxy: SOCKS5 Stopped")
+
+			err := p.ListenSOCKS5(ctx, cfg.Proxy.PortSOCKS5)
+			if err != nil {
+				logger.Error("SOCKS5 Proxy failed to listen", zap.Error(err))
+			}
+		}()
+	}
+
 	//Goroutine responsible for the publishing threads statistics
 	go func() {
 		options, err := redis.ParseURL(fmt.Sprintf("%s/%d", cfg.Redis.DSN, cfg.Redis.DB.Data))
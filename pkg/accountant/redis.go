@@ -2,75 +2,203 @@ package accountant
 
 import (
 	"context"
-	"strconv"
+	"encoding/json"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-redis/redis/v8"
-	"github.com/valyala/bytebufferpool"
+	"github.com/omimic12/proxy-server/pkg"
+	"github.com/omimic12/proxy-server/pkg/measure"
 	"go.uber.org/zap"
 )
 
+const shards = 32
+
+// Redis - usage aggregated per password and published as one JSON object of password to bytes per period.
+// Decrement never blocks on redis, a password arriving while maxEntries are pending is counted as overflow,
+// a batch nobody received is carried into the next one as far as maxEntries allow and dropped otherwise.
+// Lost usage and failed batches are counted as errors of the measure.
 type Redis struct {
-	data chan string
+	shards     [shards]shard
+	entries    atomic.Int64
+	maxEntries int64
+
+	measure pkg.Measure
+
+	published     atomic.Int64
+	overflow      atomic.Int64
+	overflowBytes atomic.Int64
+	dropped       atomic.Int64
+	droppedBytes  atomic.Int64
 }
 
-const (
-	strColon = ":"
-)
+type shard struct {
+	mu    sync.Mutex
+	usage map[string]int64
+}
+
+// Stats - counters of the accountant since start
+type Stats struct {
+	Pending       int64
+	Published     int64
+	Overflow      int64
+	OverflowBytes int64
+	Dropped       int64
+	DroppedBytes  int64
+}
 
 func NewRedis(
 	ctx context.Context,
-	bufferSize int,
+	maxEntries int,
 	dataChName string,
 	client *redis.Client,
 	period time.Duration,
+	measure pkg.Measure,
 	logger *zap.Logger,
 ) (*Redis, error) {
-	var data = make(chan string, bufferSize)
+	r := &Redis{maxEntries: int64(maxEntries), measure: measure}
+	for i := range r.shards {
+		r.shards[i].usage = make(map[string]int64)
+	}
+
 	go func() {
 		ticker := time.NewTicker(period)
 		defer ticker.Stop()
 
-		buf := bytebufferpool.Get()
-		defer bytebufferpool.Put(buf)
-
+		var reported Stats
 		for {
 			select {
 			case <-ctx.Done():
 				return
 			case <-ticker.C:
-				if buf.Len() == 0 {
-					continue
-				}
+				r.publish(client, dataChName, logger)
 
-				_, err := client.Publish(context.Background(), dataChName, buf.String()).Result()
-				if err != nil {
-					logger.Error("failed to publish data", zap.Error(err))
-				}
-				buf.Reset()
-			case d := <-data:
-				if buf.Len() > 0 {
-					_, err := buf.WriteString(strColon)
-					if err != nil {
-						logger.Error("failed to write semicolon to buffer", zap.Error(err))
-						continue
-					}
-				}
-
-				_, err := buf.WriteString(d)
-				if err != nil {
-					logger.Error("failed to write usage data to buffer", zap.Error(err))
+				stats := r.Stats()
+				if stats.Overflow != reported.Overflow || stats.Dropped != reported.Dropped {
+					logger.Warn("usage lost",
+						zap.Int64("pending", stats.Pending),
+						zap.Int64("overflow", stats.Overflow),
+						zap.Int64("overflow_bytes", stats.OverflowBytes),
+						zap.Int64("dropped", stats.Dropped),
+						zap.Int64("dropped_bytes", stats.DroppedBytes))
 				}
+				reported = stats
 			}
 		}
 	}()
 
-	return &Redis{
-		data: data,
-	}, nil
+	return r, nil
 }
 
 func (r *Redis) Decrement(password string, bytes int64) error {
-	r.data <- password + "," + strconv.FormatInt(bytes, 10)
+	r.add(password, bytes, false)
 	return nil
 }
+
+// Stats - counters of the accountant since start
+func (r *Redis) Stats() Stats {
+	return Stats{
+		Pending:       r.entries.Load(),
+		Published:     r.published.Load(),
+		Overflow:      r.overflow.Load(),
+		OverflowBytes: r.overflowBytes.Load(),
+		Dropped:       r.dropped.Load(),
+		DroppedBytes:  r.droppedBytes.Load(),
+	}
+}
+
+// add - aggregate bytes of the password, false when the password did not fit
+func (r *Redis) add(password string, bytes int64, carried bool) bool {
+	if r.store(password, bytes) {
+		return true
+	}
+
+	if carried {
+		r.dropped.Add(1)
+		r.droppedBytes.Add(bytes)
+		r.measure.CountError(password, measure.ErrorsUsageDropped) //nolint:errcheck
+	} else {
+		r.overflow.Add(1)
+		r.overflowBytes.Add(bytes)
+		r.measure.CountError(password, measure.ErrorsUsageOverflow) //nolint:errcheck
+	}
+	return false
+}
+
+// store - aggregate bytes of the password, false when a new password exceeds maxEntries
+func (r *Redis) store(password string, bytes int64) bool {
+	s := &r.shards[shardOf(password)]
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.usage[password]; !ok {
+		if r.entries.Add(1) > r.maxEntries {
+			r.entries.Add(-1)
+			return false
+		}
+	}
+
+	s.usage[password] += bytes
+	return true
+}
+
+// collect - take the usage aggregated so far
+func (r *Redis) collect() map[string]int64 {
+	usage := make(map[string]int64)
+	for i := range r.shards {
+		s := &r.shards[i]
+
+		s.mu.Lock()
+		for password, bytes := range s.usage {
+			usage[password] = bytes
+		}
+		r.entries.Add(-int64(len(s.usage)))
+		s.usage = make(map[string]int64)
+		s.mu.Unlock()
+	}
+	return usage
+}
+
+func (r *Redis) publish(client *redis.Client, dataChName string, logger *zap.Logger) {
+	usage := r.collect()
+	if len(usage) == 0 {
+		return
+	}
+
+	data, err := json.Marshal(usage)
+	if err != nil {
+		logger.Error("failed to encode usage data", zap.Error(err))
+		return
+	}
+
+	receivers, err := client.Publish(context.Background(), dataChName, data).Result()
+	if err == nil && receivers > 0 {
+		r.published.Add(int64(len(usage)))
+		return
+	}
+
+	// the batch is not owned by a password, its errors are counted without one
+	if err != nil {
+		logger.Error("failed to publish data", zap.Error(err))
+		r.measure.CountError("", measure.ErrorsUsagePublish) //nolint:errcheck
+	} else {
+		logger.Error("published data was not received", zap.String("channel", dataChName))
+		r.measure.CountError("", measure.ErrorsUsageNotReceived) //nolint:errcheck
+	}
+
+	for password, bytes := range usage {
+		r.add(password, bytes, true)
+	}
+}
+
+// shardOf - FNV-1a of the password
+func shardOf(password string) uint32 {
+	h := uint32(2166136261)
+	for i := 0; i < len(password); i++ {
+		h ^= uint32(password[i])
+		h *= 16777619
+	}
+	return h % shards
+}
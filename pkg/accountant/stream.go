@@ -0,0 +1,284 @@
+package accountant
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+const (
+	streamRetries    = 5
+	streamBackoff    = 100 * time.Millisecond
+	streamBackoffMax = 5 * time.Second
+	streamFlushLimit = 10 * time.Second
+)
+
+// Stream - usage aggregated per password and appended to a redis stream every period.
+// Batches redis does not take are spooled on disk and sent before the next one,
+// the usage collected so far is flushed on Close, once nothing decrements anymore.
+type Stream struct {
+	mu    sync.Mutex
+	usage map[string]int64
+
+	client *redis.Client
+	stream string
+	maxLen int64
+	spool  string
+
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+
+	logger *zap.Logger
+}
+
+// batch - usage of one flush window, consumers dedupe retried batches by ID
+type batch struct {
+	ID    string           `json:"id"`
+	At    int64            `json:"at"`
+	Usage map[string]int64 `json:"usage"`
+}
+
+func NewStream(
+	ctx context.Context,
+	client *redis.Client,
+	stream string,
+	maxLen int64,
+	spool string,
+	period time.Duration,
+	logger *zap.Logger,
+) (*Stream, error) {
+	s := &Stream{
+		usage:  make(map[string]int64),
+		client: client,
+		stream: stream,
+		maxLen: maxLen,
+		spool:  spool,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+		logger: logger,
+	}
+
+	go func() {
+		defer close(s.done)
+
+		ticker := time.NewTicker(period)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				s.flush(ctx)
+			case <-ctx.Done():
+				// connections still finishing decrement after the context is done, Close flushes them
+				return
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+
+	return s, nil
+}
+
+func (s *Stream) Decrement(password string, bytes int64) error {
+	s.mu.Lock()
+	s.usage[password] += bytes
+	s.mu.Unlock()
+	return nil
+}
+
+// Close - stop and flush the collected usage, to be called once the data path is stopped
+func (s *Stream) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.stop)
+		<-s.done
+
+		s.final()
+	})
+	return nil
+}
+
+// final - last flush, it outlives the service context
+func (s *Stream) final() {
+	ctx, cancel := context.WithTimeout(context.Background(), streamFlushLimit)
+	defer cancel()
+
+	s.flush(ctx)
+}
+
+func (s *Stream) flush(ctx context.Context) {
+	s.mu.Lock()
+	usage := s.usage
+	s.usage = make(map[string]int64)
+	s.mu.Unlock()
+
+	// spooled batches go first so the stream keeps the order of the windows
+	if err := s.drain(ctx); err != nil {
+		if len(usage) > 0 {
+			s.save(batch{ID: uuid.New().String(), At: time.Now().UnixMilli(), Usage: usage})
+		}
+		return
+	}
+
+	if len(usage) == 0 {
+		return
+	}
+
+	b := batch{ID: uuid.New().String(), At: time.Now().UnixMilli(), Usage: usage}
+	if err := s.send(ctx, b); err != nil {
+		s.logger.Error("failed to append usage, spooling", zap.String("batch", b.ID), zap.Error(err))
+		s.save(b)
+	}
+}
+
+// send - append the batch, retrying with backoff
+func (s *Stream) send(ctx context.Context, b batch) error {
+	usage, err := json.Marshal(b.Usage)
+	if err != nil {
+		return err
+	}
+
+	args := &redis.XAddArgs{
+		Stream: s.stream,
+		Values: []interface{}{"id", b.ID, "at", b.At, "usage", usage},
+	}
+	if s.maxLen > 0 {
+		args.MaxLen = s.maxLen
+		args.Approx = true
+	}
+
+	backoff := streamBackoff
+	for attempt := 1; ; attempt++ {
+		err = s.client.XAdd(ctx, args).Err()
+		if err == nil || attempt == streamRetries {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > streamBackoffMax {
+			backoff = streamBackoffMax
+		}
+	}
+}
+
+// save - append the batch to the spool
+func (s *Stream) save(b batch) {
+	data, err := json.Marshal(b)
+	if err != nil {
+		s.logger.Error("failed to encode usage batch", zap.String("batch", b.ID), zap.Error(err))
+		return
+	}
+
+	f, err := os.OpenFile(s.spool, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		s.logger.Error("failed to open usage spool", zap.String("batch", b.ID), zap.Error(err))
+		return
+	}
+	defer f.Close() //nolint:errcheck
+
+	if _, err = f.Write(append(data, '\n')); err != nil {
+		s.logger.Error("failed to spool usage", zap.String("batch", b.ID), zap.Error(err))
+		return
+	}
+
+	if err = f.Sync(); err != nil {
+		s.logger.Error("failed to sync usage spool", zap.Error(err))
+	}
+}
+
+// drain - send the spooled batches, the ones left unsent are kept in the spool
+func (s *Stream) drain(ctx context.Context) error {
+	batches, err := s.load()
+	if err != nil || len(batches) == 0 {
+		return err
+	}
+
+	for i, b := range batches {
+		if err = s.send(ctx, b); err != nil {
+			s.logger.Error("failed to append spooled usage", zap.Int("pending", len(batches)-i), zap.Error(err))
+			if rewriteErr := s.rewrite(batches[i:]); rewriteErr != nil {
+				s.logger.Error("failed to rewrite usage spool", zap.Error(rewriteErr))
+			}
+			return err
+		}
+	}
+
+	if err = os.Remove(s.spool); err != nil && !errors.Is(err, os.ErrNotExist) {
+		s.logger.Error("failed to remove usage spool", zap.Error(err))
+	}
+	return nil
+}
+
+func (s *Stream) load() ([]batch, error) {
+	f, err := os.Open(s.spool)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		s.logger.Error("failed to open usage spool", zap.Error(err))
+		return nil, err
+	}
+	defer f.Close() //nolint:errcheck
+
+	var batches []batch
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		var b batch
+		if err := json.Unmarshal(scanner.Bytes(), &b); err != nil {
+			// a torn write of a crash, the rest of the spool is still valid
+			s.logger.Error("invalid spooled usage", zap.Error(err))
+			continue
+		}
+		batches = append(batches, b)
+	}
+
+	return batches, scanner.Err()
+}
+
+// rewrite - replace the spool with the batches atomically
+func (s *Stream) rewrite(batches []batch) error {
+	tmp := s.spool + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	for _, b := range batches {
+		data, err := json.Marshal(b)
+		if err != nil {
+			f.Close() //nolint:errcheck
+			return err
+		}
+		w.Write(append(data, '\n')) //nolint:errcheck
+	}
+
+	if err = w.Flush(); err != nil {
+		f.Close() //nolint:errcheck
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close() //nolint:errcheck
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, s.spool)
+}
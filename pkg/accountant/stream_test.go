@@ -0,0 +1,144 @@
+package accountant
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"go.uber.org/zap"
+)
+
+// fakeRedis - records the XADD commands, enough for Stream
+type fakeRedis struct {
+	mu    sync.Mutex
+	xadds [][]string
+}
+
+func (f *fakeRedis) serve(t *testing.T) *redis.Client {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.handle(conn)
+		}
+	}()
+
+	client := redis.NewClient(&redis.Options{Addr: ln.Addr().String()})
+	t.Cleanup(func() {
+		client.Close() //nolint:errcheck
+		ln.Close()     //nolint:errcheck
+	})
+	return client
+}
+
+func (f *fakeRedis) handle(conn net.Conn) {
+	defer conn.Close() //nolint:errcheck
+
+	r := bufio.NewReader(conn)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+
+		reply := "+OK\r\n"
+		if strings.ToUpper(args[0]) == "XADD" {
+			f.mu.Lock()
+			f.xadds = append(f.xadds, args)
+			f.mu.Unlock()
+			reply = "$3\r\n1-0\r\n"
+		}
+
+		if _, err = io.WriteString(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+// readCommand - RESP array of bulk strings
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil || n <= 0 {
+		return nil, fmt.Errorf("invalid command %q", line)
+	}
+
+	args := make([]string, n)
+	for i := range args {
+		line, err = r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+
+		size, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+		if err != nil {
+			return nil, err
+		}
+
+		buf := make([]byte, size+2)
+		if _, err = io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+
+	return args, nil
+}
+
+// TestStreamCloseAfterCancel - usage decremented after the context is done is written by Close
+func TestStreamCloseAfterCancel(t *testing.T) {
+	f := &fakeRedis{}
+	client := f.serve(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s, err := NewStream(ctx, client, "usage", 0, filepath.Join(t.TempDir(), "usage.spool"), time.Hour, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+	<-s.done
+
+	s.Decrement("pass", 100) //nolint:errcheck
+	s.Decrement("pass", 20)  //nolint:errcheck
+
+	if err = s.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	s.Close() //nolint:errcheck
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if len(f.xadds) != 1 {
+		t.Fatalf("XADD count = %d, want 1", len(f.xadds))
+	}
+
+	// XADD usage * id <id> at <at> usage <usage>
+	args := f.xadds[0]
+	if want := `{"pass":120}`; args[len(args)-2] != "usage" || args[len(args)-1] != want {
+		t.Errorf("XADD %v, want usage %s", args, want)
+	}
+}
@@ -3,6 +3,7 @@ package pkg
 import (
 	"context"
 	"errors"
+	"net"
 )
 
 var (
@@ -15,4 +16,7 @@ var (
 
 type Auth interface {
 	Authenticate(ctx context.Context, password string) (*Purchase, error)
+
+	//AuthenticateIP - password of the purchase allowlisting the client ip, for clients sending no credentials
+	AuthenticateIP(ctx context.Context, ip net.IP) (string, error)
 }
@@ -0,0 +1,168 @@
+package auth
+
+import (
+	"context"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/omimic12/proxy-server/pkg"
+	"github.com/tidwall/gjson"
+)
+
+const (
+	// allowlistScanCount - passwords requested per SSCAN page of the index, every page is fetched with one MGET
+	allowlistScanCount = 1000
+)
+
+// allowlist - client networks authenticating without credentials, mapped to the password of their purchase.
+// It is built from the allowed_ips of the purchase records listed in the index set.
+type allowlist struct {
+	// purchases - allowed networks by password, guarded by mu
+	mu        sync.Mutex
+	purchases map[string]allowedPurchase
+
+	// entries - flattened networks, most specific first, replaced as a whole on every change
+	entries atomic.Pointer[[]allowlistEntry]
+}
+
+type allowedPurchase struct {
+	id       uint
+	networks []*net.IPNet
+}
+
+type allowlistEntry struct {
+	network  *net.IPNet
+	ones     int
+	id       uint
+	password string
+}
+
+// lookup - password of the most specific network containing ip, the lowest purchase ID wins between equal ones
+func (a *allowlist) lookup(ip net.IP) (string, bool) {
+	entries := a.entries.Load()
+	if entries == nil {
+		return "", false
+	}
+
+	for _, entry := range *entries {
+		if entry.network.Contains(ip) {
+			return entry.password, true
+		}
+	}
+	return "", false
+}
+
+// load - replace the entries with the allowed networks of the purchases listed in the index set
+func (a *allowlist) load(ctx context.Context, client *redis.Client, index string) error {
+	purchases := make(map[string]allowedPurchase)
+
+	var cursor uint64
+	for {
+		passwords, next, err := client.SScan(ctx, index, cursor, "", allowlistScanCount).Result()
+		if err != nil {
+			return err
+		}
+
+		if len(passwords) > 0 {
+			values, err := client.MGet(ctx, passwords...).Result()
+			if err != nil {
+				return err
+			}
+
+			for i, value := range values {
+				// nil when the purchase was deleted before leaving the index
+				if str, ok := value.(string); ok {
+					if purchase, ok := allowed([]byte(str)); ok {
+						purchases[passwords[i]] = purchase
+					}
+				}
+			}
+		}
+
+		cursor = next
+		if cursor == 0 {
+			break
+		}
+	}
+
+	a.mu.Lock()
+	a.purchases = purchases
+	a.flatten()
+	a.mu.Unlock()
+
+	return nil
+}
+
+// reload - refresh the allowed networks of a single purchase record
+func (a *allowlist) reload(ctx context.Context, client *redis.Client, password string) error {
+	data, err := client.Get(ctx, password).Bytes()
+	if err != nil && err != redis.Nil {
+		return err
+	}
+
+	purchase, ok := allowed(data)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.purchases == nil {
+		a.purchases = make(map[string]allowedPurchase)
+	}
+
+	if _, found := a.purchases[password]; !found && !ok {
+		return nil
+	}
+
+	if ok {
+		a.purchases[password] = purchase
+	} else {
+		delete(a.purchases, password)
+	}
+	a.flatten()
+
+	return nil
+}
+
+// flatten - publish the networks for lookups, mu must be held
+func (a *allowlist) flatten() {
+	entries := make([]allowlistEntry, 0, len(a.purchases))
+	for password, purchase := range a.purchases {
+		for _, network := range purchase.networks {
+			ones, _ := network.Mask.Size()
+			entries = append(entries, allowlistEntry{network: network, ones: ones, id: purchase.id, password: password})
+		}
+	}
+
+	// Overlapping networks resolve to the longest prefix, then to the lowest purchase ID
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].ones != entries[j].ones {
+			return entries[i].ones > entries[j].ones
+		}
+		if entries[i].id != entries[j].id {
+			return entries[i].id < entries[j].id
+		}
+		return entries[i].password < entries[j].password
+	})
+
+	a.entries.Store(&entries)
+}
+
+// allowed - ID and allowed_ips of a purchase record, invalid networks are reported by Authenticate
+func allowed(data []byte) (allowedPurchase, bool) {
+	purchase := allowedPurchase{id: uint(gjson.GetBytes(data, "id").Uint())}
+
+	allowedIPs := gjson.GetBytes(data, "allowed_ips")
+	if allowedIPs.IsArray() {
+		allowedIPs.ForEach(func(key, value gjson.Result) bool {
+			if network, err := pkg.ParseNetwork(value.String()); err == nil {
+				purchase.networks = append(purchase.networks, network)
+			}
+			return true
+		})
+	}
+
+	return purchase, len(purchase.networks) > 0
+}
@@ -0,0 +1,58 @@
+package auth
+
+import (
+	"net"
+	"testing"
+
+	"github.com/omimic12/proxy-server/pkg"
+)
+
+func TestAllowlistLookup(t *testing.T) {
+	networks := func(cidrs ...string) []*net.IPNet {
+		var parsed []*net.IPNet
+		for _, cidr := range cidrs {
+			network, err := pkg.ParseNetwork(cidr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			parsed = append(parsed, network)
+		}
+		return parsed
+	}
+
+	a := &allowlist{purchases: map[string]allowedPurchase{
+		"wide":      {id: 1, networks: networks("10.0.0.0/8")},
+		"narrow":    {id: 2, networks: networks("10.1.0.0/16")},
+		"tie-late":  {id: 9, networks: networks("10.2.0.0/16")},
+		"tie-early": {id: 3, networks: networks("10.2.0.0/16")},
+		"single":    {id: 4, networks: networks("192.0.2.7")},
+	}}
+	a.flatten()
+
+	tests := []struct {
+		name     string
+		ip       string
+		password string
+		found    bool
+	}{
+		{name: "only match", ip: "10.9.0.1", password: "wide", found: true},
+		{name: "longest prefix", ip: "10.1.2.3", password: "narrow", found: true},
+		{name: "equal prefixes resolve to the lowest purchase id", ip: "10.2.0.1", password: "tie-early", found: true},
+		{name: "single address", ip: "192.0.2.7", password: "single", found: true},
+		{name: "not allowed", ip: "192.0.2.8"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the map order must not change the result
+			for i := 0; i < 10; i++ {
+				a.flatten()
+
+				password, found := a.lookup(net.ParseIP(tt.ip))
+				if password != tt.password || found != tt.found {
+					t.Fatalf("lookup(%s) = %q, %v, want %q, %v", tt.ip, password, found, tt.password, tt.found)
+				}
+			}
+		})
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net"
 	"time"
 
 	"github.com/bluele/gcache"
@@ -19,6 +20,8 @@ type RedisGCache struct {
 	redisPurchase *redis.Client
 	cache         gcache.Cache
 	cacheTTL      time.Duration
+	allowlist     allowlist
+	allowlistKey  string
 	logger        *zap.Logger
 }
 
@@ -27,6 +30,8 @@ func NewRedisGCache(
 	records int,
 	cacheTTL time.Duration,
 	redisCh string,
+	allowlistKey string,
+	allowlistSync time.Duration,
 	redisData, redisPurchase *redis.Client,
 	parser pkg.UsernameParser,
 	logger *zap.Logger,
@@ -41,21 +46,34 @@ func NewRedisGCache(
 		redisPurchase: redisPurchase,
 		cache:         cache,
 		cacheTTL:      cacheTTL,
+		allowlistKey:  allowlistKey,
 		logger:        logger,
 	}
 
+	err := r.allowlist.load(signalCtx, redisPurchase, allowlistKey)
+	if err != nil {
+		return nil, err
+	}
+
 	go func() {
 		deleteCh := redisData.Subscribe(context.Background(), redisCh).Channel()
 		defer func() {
 			cache.Purge()
 		}()
 
+		ticker := time.NewTicker(allowlistSync)
+		defer ticker.Stop()
+
 		for {
 			select {
 			case <-signalCtx.Done():
 				return
 			case data := <-deleteCh:
 				cache.Remove(data.Payload)
+				// the purchase may have changed its allowed networks
+				r.reloadAllowed(data.Payload)
+			case <-ticker.C:
+				r.reloadAllowlist()
 			}
 		}
 	}()
@@ -89,6 +107,11 @@ func (r *RedisGCache) Authenticate(ctx context.Context, password string) (*pkg.P
 			IPVersion:        pkg.IPVersion(gjson.GetBytes(data, "ip_version").String()),
 			Sticky:           gjson.GetBytes(data, "sticky").Bool(),
 			CountryTargeting: gjson.GetBytes(data, "country_targeting").Bool(),
+			RPS:              gjson.GetBytes(data, "rps").Float(),
+			Burst:            gjson.GetBytes(data, "burst").Int(),
+			UploadBPS:        gjson.GetBytes(data, "upload_bps").Int(),
+			DownloadBPS:      gjson.GetBytes(data, "download_bps").Int(),
+			Pool:             gjson.GetBytes(data, "pool").String(),
 		}
 
 		bandwidthLimited := gjson.GetBytes(data, "bandwidth_limited").Bool()
@@ -106,6 +129,34 @@ func (r *RedisGCache) Authenticate(ctx context.Context, password string) (*pkg.P
 		}
 		purchase.BandwidthLimited = bandwidthLimited
 
+		allowedIPs := gjson.GetBytes(data, "allowed_ips")
+		if allowedIPs.IsArray() {
+			allowedIPs.ForEach(func(key, value gjson.Result) bool {
+				network, err := pkg.ParseNetwork(value.String())
+				if err != nil {
+					r.logger.Error("invalid purchase allowed ip", zap.Uint("purchase", purchase.ID), zap.Error(err))
+					return true
+				}
+
+				purchase.AllowedIPs = append(purchase.AllowedIPs, network)
+				return true
+			})
+		}
+
+		subnets := gjson.GetBytes(data, "subnets")
+		if subnets.IsArray() {
+			subnets.ForEach(func(key, value gjson.Result) bool {
+				network, err := pkg.ParseNetwork(value.String())
+				if err != nil {
+					r.logger.Error("invalid purchase subnet", zap.Uint("purchase", purchase.ID), zap.Error(err))
+					return true
+				}
+
+				purchase.Subnets = append(purchase.Subnets, network)
+				return true
+			})
+		}
+
 		ips := gjson.GetBytes(data, "ips")
 		if ips.IsArray() {
 			ips.ForEach(func(key, value gjson.Result) bool {
@@ -140,3 +191,26 @@ func (r *RedisGCache) Authenticate(ctx context.Context, password string) (*pkg.P
 
 	return purchase, nil
 }
+
+func (r *RedisGCache) AuthenticateIP(_ context.Context, ip net.IP) (string, error) {
+	password, ok := r.allowlist.lookup(ip)
+	if !ok {
+		return "", pkg.ErrPurchaseNotFound
+	}
+
+	return password, nil
+}
+
+func (r *RedisGCache) reloadAllowlist() {
+	err := r.allowlist.load(context.Background(), r.redisPurchase, r.allowlistKey)
+	if err != nil {
+		r.logger.Error("failed to load allowlist", zap.Error(err))
+	}
+}
+
+func (r *RedisGCache) reloadAllowed(password string) {
+	err := r.allowlist.reload(context.Background(), r.redisPurchase, password)
+	if err != nil {
+		r.logger.Error("failed to reload allowed networks", zap.Error(err))
+	}
+}
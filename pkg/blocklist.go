@@ -0,0 +1,7 @@
+package pkg
+
+// Blocklist - destinations purchases may not reach
+type Blocklist interface {
+	//Blocked - check the target host or IP is blocked for the purchase
+	Blocked(purchase *Purchase, target string) bool
+}
@@ -0,0 +1,89 @@
+package blocklist
+
+import (
+	"net"
+	"strings"
+
+	"github.com/omimic12/proxy-server/pkg"
+)
+
+const (
+	wildcardPrefix = "*."
+)
+
+// list - exact hosts, wildcard suffixes and IP networks
+type list struct {
+	exact    map[string]struct{}
+	suffixes map[string]struct{}
+	networks []*net.IPNet
+}
+
+func newList() *list {
+	return &list{
+		exact:    make(map[string]struct{}),
+		suffixes: make(map[string]struct{}),
+	}
+}
+
+// add - add an entry, *.example.com blocks every subdomain, example.com the host only
+func (l *list) add(entry string) error {
+	entry = normalize(entry)
+	if entry == "" {
+		return nil
+	}
+
+	if strings.HasPrefix(entry, wildcardPrefix) {
+		l.suffixes[entry[len(wildcardPrefix):]] = struct{}{}
+		return nil
+	}
+
+	if strings.Contains(entry, "/") || net.ParseIP(entry) != nil {
+		network, err := pkg.ParseNetwork(entry)
+		if err != nil {
+			return err
+		}
+
+		l.networks = append(l.networks, network)
+		return nil
+	}
+
+	l.exact[entry] = struct{}{}
+	return nil
+}
+
+// blocked - check a normalized host, ip is set when the host is an IP address
+func (l *list) blocked(host string, ip net.IP) bool {
+	if l == nil {
+		return false
+	}
+
+	if ip != nil {
+		for _, network := range l.networks {
+			if network.Contains(ip) {
+				return true
+			}
+		}
+	}
+
+	if _, ok := l.exact[host]; ok {
+		return true
+	}
+
+	// Walk the parent domains, a.b.example.com checks b.example.com, example.com and com
+	for i := strings.IndexByte(host, '.'); i >= 0; i = strings.IndexByte(host, '.') {
+		host = host[i+1:]
+		if _, ok := l.suffixes[host]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+func normalize(host string) string {
+	host = strings.TrimSpace(host)
+	host = strings.TrimPrefix(host, "[")
+	host = strings.TrimSuffix(host, "]")
+	host = strings.TrimSuffix(host, ".")
+	return strings.ToLower(host)
+}
@@ -0,0 +1,149 @@
+package blocklist
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/omimic12/proxy-server/pkg"
+	"go.uber.org/zap"
+)
+
+const (
+	keyGlobal   = "global"
+	keyType     = "type:"
+	keyPurchase = "purchase:"
+)
+
+// Redis - blocklists kept in redis sets <prefix>global, <prefix>type:<purchase type> and <prefix>purchase:<purchase id>
+type Redis struct {
+	client *redis.Client
+	prefix string
+	lists  atomic.Pointer[lists]
+	logger *zap.Logger
+}
+
+type lists struct {
+	global    *list
+	types     map[string]*list
+	purchases map[uint]*list
+}
+
+func NewRedis(ctx context.Context, client *redis.Client, prefix string, logger *zap.Logger) (*Redis, error) {
+	r := &Redis{
+		client: client,
+		prefix: prefix,
+		logger: logger,
+	}
+
+	err := r.load(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func (r *Redis) Blocked(purchase *pkg.Purchase, target string) bool {
+	host := normalize(target)
+	ip := net.ParseIP(host)
+
+	l := r.lists.Load()
+	return l.global.blocked(host, ip) ||
+		l.types[purchase.Type].blocked(host, ip) ||
+		l.purchases[purchase.ID].blocked(host, ip)
+}
+
+// Listen - reload the lists every period and whenever channel is notified
+func (r *Redis) Listen(ctx context.Context, period time.Duration, channel string) error {
+	sub := r.client.Subscribe(ctx, channel)
+	defer sub.Close() //nolint:errcheck
+
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-sub.Channel():
+		case <-ticker.C:
+		}
+
+		if err := r.load(ctx); err != nil {
+			r.logger.Error("failed to reload blocklists", zap.Error(err))
+		}
+	}
+}
+
+func (r *Redis) load(ctx context.Context) error {
+	var next = &lists{
+		global:    newList(),
+		types:     make(map[string]*list),
+		purchases: make(map[uint]*list),
+	}
+
+	var cursor uint64
+	for {
+		keys, c, err := r.client.Scan(ctx, cursor, r.prefix+"*", 0).Result()
+		if err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			l, ok := next.list(strings.TrimPrefix(key, r.prefix))
+			if !ok {
+				r.logger.Error("unsupported blocklist", zap.String("key", key))
+				continue
+			}
+
+			entries, err := r.client.SMembers(ctx, key).Result()
+			if err != nil {
+				return err
+			}
+
+			for _, entry := range entries {
+				if err := l.add(entry); err != nil {
+					r.logger.Error("invalid blocklist entry", zap.String("key", key), zap.String("entry", entry), zap.Error(err))
+				}
+			}
+		}
+
+		cursor = c
+		if cursor == 0 {
+			break
+		}
+	}
+
+	r.lists.Store(next)
+	return nil
+}
+
+// list - list of the key without prefix, created on first use
+func (l *lists) list(name string) (*list, bool) {
+	switch {
+	case name == keyGlobal:
+		return l.global, true
+	case strings.HasPrefix(name, keyType):
+		t := strings.TrimPrefix(name, keyType)
+		if _, ok := l.types[t]; !ok {
+			l.types[t] = newList()
+		}
+		return l.types[t], true
+	case strings.HasPrefix(name, keyPurchase):
+		id, err := strconv.ParseUint(strings.TrimPrefix(name, keyPurchase), 10, 64)
+		if err != nil {
+			return nil, false
+		}
+		if _, ok := l.purchases[uint(id)]; !ok {
+			l.purchases[uint(id)] = newList()
+		}
+		return l.purchases[uint(id)], true
+	default:
+		return nil, false
+	}
+}
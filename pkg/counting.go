@@ -0,0 +1,76 @@
+package pkg
+
+import (
+	"io"
+	"sync"
+)
+
+// countingReader - meters a request body while the transport streams it upstream.
+// The transport may keep reading after the response arrived, so metering is locked
+// and the remainder is reported on Close.
+type countingReader struct {
+	mu    sync.Mutex
+	body  io.ReadCloser
+	meter *meter
+	done  <-chan struct{}
+	read  int64
+}
+
+func (p *Proxy) newCountingReader(body io.ReadCloser, m *meter, done <-chan struct{}) *countingReader {
+	return &countingReader{body: body, meter: m, done: done}
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.body.Read(b)
+	if n > 0 {
+		c.mu.Lock()
+		c.read += int64(n)
+		c.meter.add(int64(n)) //nolint:errcheck
+		c.mu.Unlock()
+
+		if !c.meter.throttle(int64(n), c.done) {
+			return n, ErrConnectionClosed
+		}
+	}
+	return n, err
+}
+
+func (c *countingReader) Close() error {
+	c.flush()
+	return c.body.Close()
+}
+
+// flush - report pending bytes and return the total read so far
+func (c *countingReader) flush() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.meter.accounted > 0 {
+		c.meter.flush() //nolint:errcheck
+	}
+	return c.read
+}
+
+// countingWriter - meters a response body while it is streamed to the client
+type countingWriter struct {
+	w       io.Writer
+	request *Request
+	meter   *meter
+}
+
+func (p *Proxy) newCountingWriter(w io.Writer, request *Request, m *meter) *countingWriter {
+	return &countingWriter{w: w, request: request, meter: m}
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	if !c.meter.throttle(int64(len(b)), c.request.Done) {
+		return 0, ErrConnectionClosed
+	}
+
+	n, err := c.w.Write(b)
+	if n > 0 {
+		c.request.Inc(int64(n))
+		c.meter.add(int64(n)) //nolint:errcheck
+	}
+	return n, err
+}
@@ -16,3 +16,8 @@ type Dialer interface {
 	Protocol() Protocol
 	Dial(uri []byte, addr string, username, password []byte) (net.Conn, error)
 }
+
+// PacketDialer - implemented by dialers able to relay UDP datagrams through the upstream proxy
+type PacketDialer interface {
+	DialPacket(addr string, username, password []byte) (net.PacketConn, error)
+}
@@ -13,14 +13,17 @@ import (
 )
 
 var (
-	byteHTTP11   = []byte(" HTTP/1.1\r\n")
-	byteConnect  = []byte("CONNECT ")
-	byteOKStatus = []byte(" 200")
-	byteColon    = []byte(":")
+	byteHTTP11     = []byte(" HTTP/1.1\r\n")
+	byteConnect    = []byte("CONNECT ")
+	byteOKStatus   = []byte("200")
+	byteAuthStatus = []byte("407")
+	byteColon      = []byte(":")
+	byteLF         = []byte("\n")
 )
 
 var (
-	errBadStatusCode = errors.New("bad status code")
+	errBadStatusCode     = fmt.Errorf("bad status code: %w", pkg.ErrTargetRefused)
+	errProxyAuthRequired = errors.New("proxy authentication required")
 )
 
 const (
@@ -81,7 +84,13 @@ func (d *HTTP) Dial(uri []byte, addr string, username, password []byte) (rc net.
 		return nil, err
 	}
 
-	if !bytes.Contains(buf[:n], byteOKStatus) {
+	// the upstream answers for the target unless it rejects the credentials
+	switch status := statusCode(buf[:n]); {
+	case bytes.Equal(status, byteOKStatus):
+	case bytes.Equal(status, byteAuthStatus):
+		rc.Close() //nolint:errcheck
+		return nil, errProxyAuthRequired
+	default:
 		rc.Close() //nolint:errcheck
 		return nil, errBadStatusCode
 	}
@@ -89,6 +98,19 @@ func (d *HTTP) Dial(uri []byte, addr string, username, password []byte) (rc net.
 	return
 }
 
+// statusCode - status code of the status line starting the response
+func statusCode(response []byte) []byte {
+	if i := bytes.Index(response, byteLF); i >= 0 {
+		response = response[:i]
+	}
+
+	fields := bytes.Fields(response)
+	if len(fields) < 2 {
+		return nil
+	}
+	return fields[1]
+}
+
 func (d *HTTP) Protocol() pkg.Protocol {
 	return pkg.HTTP
 }
@@ -0,0 +1,71 @@
+package dialer
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/omimic12/proxy-server/pkg"
+)
+
+// fakeHTTPProxy - upstream answering a single CONNECT with status
+func fakeHTTPProxy(t *testing.T, status string) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() }) //nolint:errcheck
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close() //nolint:errcheck
+
+		if _, err = http.ReadRequest(bufio.NewReader(conn)); err != nil {
+			return
+		}
+		conn.Write([]byte("HTTP/1.1 " + status + "\r\n\r\n")) //nolint:errcheck
+	}()
+
+	return ln.Addr().String()
+}
+
+func TestHTTPConnectStatus(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  string
+		err     error
+		refused bool
+	}{
+		{name: "established", status: "200 Connection established"},
+		{name: "proxy auth required", status: "407 Proxy Authentication Required", err: errProxyAuthRequired},
+		{name: "bad gateway", status: "502 Bad Gateway", err: errBadStatusCode, refused: true},
+		{name: "forbidden", status: "403 Forbidden", err: errBadStatusCode, refused: true},
+		{name: "200 outside the status code", status: "503 Service Unavailable 200", err: errBadStatusCode, refused: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := fakeHTTPProxy(t, tt.status)
+
+			conn, err := NewHTTP(time.Second, time.Second).Dial([]byte("example.com:443"), addr, []byte("user"), []byte("pass"))
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Dial() error = %v, want %v", err, tt.err)
+			}
+			if err == nil {
+				conn.Close() //nolint:errcheck
+			}
+
+			if refused := errors.Is(err, pkg.ErrTargetRefused); refused != tt.refused {
+				t.Errorf("target refused = %v, want %v", refused, tt.refused)
+			}
+		})
+	}
+}
@@ -0,0 +1,261 @@
+package dialer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/omimic12/proxy-server/pkg"
+	"github.com/omimic12/proxy-server/pkg/socks5"
+)
+
+var (
+	errNoAcceptableMethod = errors.New("socks5: no acceptable auth method")
+	errAuthFailed         = errors.New("socks5: authentication failed")
+	errCredentialsTooLong = errors.New("socks5: username or password too long")
+	errReplyFailed        = errors.New("socks5: request failed")
+	errTargetUnreachable  = fmt.Errorf("socks5: target unreachable: %w", pkg.ErrTargetRefused)
+)
+
+const (
+	// RSV, FRAG, ATYP, the longest DST.ADDR and DST.PORT
+	maxDatagramHeader = 3 + 1 + 1 + 255 + 2
+)
+
+type SOCKS5 struct {
+	readDeadline time.Duration
+	dialTimeout  time.Duration
+}
+
+func NewSOCKS5(dialTimeout, readDeadline time.Duration) *SOCKS5 {
+	return &SOCKS5{dialTimeout: dialTimeout, readDeadline: readDeadline}
+}
+
+func (d *SOCKS5) Dial(uri []byte, addr string, username, password []byte) (rc net.Conn, err error) {
+	target, err := socks5.ParseAddr(string(uri))
+	if err != nil {
+		return nil, err
+	}
+
+	rc, _, err = d.handshake(socks5.CmdConnect, target, addr, username, password)
+	return
+}
+
+// DialPacket - open a UDP association through the upstream proxy
+func (d *SOCKS5) DialPacket(addr string, username, password []byte) (net.PacketConn, error) {
+	ctrl, relay, err := d.handshake(socks5.CmdUDPAssociate, &socks5.Addr{Host: net.IPv4zero.String()}, addr, username, password)
+	if err != nil {
+		return nil, err
+	}
+
+	// Relays listening on all interfaces reply with an unspecified address
+	if ip := net.ParseIP(relay.Host); ip == nil || ip.IsUnspecified() {
+		relay.Host, _, err = net.SplitHostPort(ctrl.RemoteAddr().String())
+		if err != nil {
+			ctrl.Close() //nolint:errcheck
+			return nil, err
+		}
+	}
+
+	conn, err := net.Dial("udp", relay.String())
+	if err != nil {
+		ctrl.Close() //nolint:errcheck
+		return nil, err
+	}
+
+	pc := &socks5PacketConn{Conn: conn, ctrl: ctrl}
+
+	// The association lives as long as the control connection
+	go func() {
+		io.Copy(io.Discard, ctrl) //nolint:errcheck
+		pc.Close()                //nolint:errcheck
+	}()
+
+	return pc, nil
+}
+
+func (d *SOCKS5) Protocol() pkg.Protocol {
+	return pkg.SOCKS5
+}
+
+// handshake - connect to the upstream, authenticate and issue cmd, returning the control connection and bound address
+func (d *SOCKS5) handshake(cmd byte, target *socks5.Addr, addr string, username, password []byte) (rc net.Conn, bound *socks5.Addr, err error) {
+	if d.dialTimeout > 0 {
+		rc, err = net.DialTimeout("tcp", addr, d.dialTimeout)
+	} else {
+		rc, err = net.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if d.dialTimeout > 0 {
+		if err = rc.SetDeadline(time.Now().Add(d.dialTimeout)); err != nil {
+			rc.Close() //nolint:errcheck
+			return nil, nil, err
+		}
+	}
+
+	bound, err = d.negotiate(rc, cmd, target, username, password)
+	if err != nil {
+		rc.Close() //nolint:errcheck
+		return nil, nil, err
+	}
+
+	if err = rc.SetDeadline(time.Time{}); err != nil {
+		rc.Close() //nolint:errcheck
+		return nil, nil, err
+	}
+
+	return rc, bound, nil
+}
+
+func (d *SOCKS5) negotiate(rc net.Conn, cmd byte, target *socks5.Addr, username, password []byte) (*socks5.Addr, error) {
+	method := byte(socks5.MethodNoAuth)
+	if username != nil && password != nil {
+		method = socks5.MethodUserPass
+	}
+
+	if _, err := rc.Write([]byte{socks5.Version, 1, method}); err != nil {
+		return nil, err
+	}
+
+	var reply [2]byte
+	if _, err := io.ReadFull(rc, reply[:]); err != nil {
+		return nil, err
+	}
+
+	if reply[0] != socks5.Version {
+		return nil, socks5.ErrInvalidVersion
+	}
+
+	if reply[1] != method {
+		return nil, errNoAcceptableMethod
+	}
+
+	if method == socks5.MethodUserPass {
+		if len(username) > 255 || len(password) > 255 {
+			return nil, errCredentialsTooLong
+		}
+
+		b := make([]byte, 0, 3+len(username)+len(password))
+		b = append(b, socks5.AuthVersion, byte(len(username)))
+		b = append(b, username...)
+		b = append(b, byte(len(password)))
+		b = append(b, password...)
+		if _, err := rc.Write(b); err != nil {
+			return nil, err
+		}
+
+		if _, err := io.ReadFull(rc, reply[:]); err != nil {
+			return nil, err
+		}
+
+		if reply[1] != socks5.AuthSuccess {
+			return nil, errAuthFailed
+		}
+	}
+
+	b, err := target.Append([]byte{socks5.Version, cmd, 0x00})
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = rc.Write(b); err != nil {
+		return nil, err
+	}
+
+	var header [3]byte
+	if _, err = io.ReadFull(rc, header[:]); err != nil {
+		return nil, err
+	}
+
+	if header[0] != socks5.Version {
+		return nil, socks5.ErrInvalidVersion
+	}
+
+	switch header[1] {
+	case socks5.ReplySucceeded:
+	case socks5.ReplyNetworkUnreachable, socks5.ReplyHostUnreachable, socks5.ReplyConnectionRefused, socks5.ReplyTTLExpired:
+		return nil, errTargetUnreachable
+	default:
+		return nil, errReplyFailed
+	}
+
+	return socks5.ReadAddr(rc)
+}
+
+// socks5PacketConn - encapsulates datagrams in SOCKS5 UDP request headers
+type socks5PacketConn struct {
+	net.Conn
+	ctrl net.Conn
+	once sync.Once
+
+	// readBuf, writeBuf - encapsulated datagrams, reused across calls and grown to the largest one
+	readMu   sync.Mutex
+	readBuf  []byte
+	writeMu  sync.Mutex
+	writeBuf []byte
+}
+
+func (c *socks5PacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	if size := len(b) + maxDatagramHeader; cap(c.readBuf) < size {
+		c.readBuf = make([]byte, size)
+	}
+	buf := c.readBuf[:len(b)+maxDatagramHeader]
+	for {
+		n, err := c.Conn.Read(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+
+		frag, addr, payload, err := socks5.ParseDatagram(buf[:n])
+		if err != nil || frag != 0 {
+			// fragmented and malformed datagrams are dropped
+			continue
+		}
+
+		return copy(b, payload), addr, nil
+	}
+}
+
+func (c *socks5PacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	target, ok := addr.(*socks5.Addr)
+	if !ok {
+		var err error
+		target, err = socks5.ParseAddr(addr.String())
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	buf, err := socks5.AppendDatagramHeader(c.writeBuf[:0], target)
+	if err != nil {
+		return 0, err
+	}
+	c.writeBuf = append(buf, b...)
+
+	if _, err = c.Conn.Write(c.writeBuf); err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+func (c *socks5PacketConn) Close() error {
+	var err error
+	c.once.Do(func() {
+		c.ctrl.Close() //nolint:errcheck
+		err = c.Conn.Close()
+	})
+	return err
+}
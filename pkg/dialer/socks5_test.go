@@ -0,0 +1,337 @@
+package dialer
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/omimic12/proxy-server/pkg/socks5"
+)
+
+// fakeSOCKS5 - upstream scripted to answer a single handshake
+type fakeSOCKS5 struct {
+	// method - selected method, whatever the client offered
+	method byte
+	// username, password - credentials accepted by the user/pass sub-negotiation
+	username, password string
+	// version, reply - VER and REP of the reply to the request
+	version, reply byte
+	// bound - ATYP, BND.ADDR and BND.PORT of the reply
+	bound []byte
+
+	// methods, request - offered methods and the request as read on the wire
+	methods chan []byte
+	request chan []byte
+}
+
+func (f *fakeSOCKS5) serve(t *testing.T) string {
+	t.Helper()
+
+	f.methods = make(chan []byte, 1)
+	f.request = make(chan []byte, 1)
+	if f.version == 0 {
+		f.version = socks5.Version
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() }) //nolint:errcheck
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close() //nolint:errcheck
+
+		f.handle(conn) //nolint:errcheck
+	}()
+
+	return ln.Addr().String()
+}
+
+func (f *fakeSOCKS5) handle(conn net.Conn) error {
+	var greeting [2]byte
+	if _, err := io.ReadFull(conn, greeting[:]); err != nil {
+		return err
+	}
+
+	methods := make([]byte, greeting[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return err
+	}
+	f.methods <- methods
+
+	if _, err := conn.Write([]byte{socks5.Version, f.method}); err != nil || f.method == socks5.MethodNoAcceptable {
+		return err
+	}
+
+	if f.method == socks5.MethodUserPass {
+		username, password, err := socks5.ReadUserPass(conn)
+		if err != nil {
+			return err
+		}
+
+		status := byte(socks5.AuthSuccess)
+		if string(username) != f.username || string(password) != f.password {
+			status = socks5.AuthFailure
+		}
+
+		if _, err = conn.Write([]byte{socks5.AuthVersion, status}); err != nil || status != socks5.AuthSuccess {
+			return err
+		}
+	}
+
+	var request bytes.Buffer
+	if _, err := io.CopyN(&request, conn, 3); err != nil {
+		return err
+	}
+	if _, err := socks5.ReadAddr(io.TeeReader(conn, &request)); err != nil {
+		return err
+	}
+	f.request <- request.Bytes()
+
+	if _, err := conn.Write(append([]byte{f.version, f.reply, 0x00}, f.bound...)); err != nil || f.reply != socks5.ReplySucceeded {
+		return err
+	}
+
+	_, err := io.Copy(conn, conn)
+	return err
+}
+
+var boundIPv4 = []byte{socks5.AddrIPv4, 10, 0, 0, 1, 0x04, 0x38}
+
+func TestSOCKS5Negotiation(t *testing.T) {
+	tests := []struct {
+		name               string
+		username, password []byte
+		method             byte
+		offered            []byte
+		err                error
+	}{
+		{
+			name:    "no auth",
+			method:  socks5.MethodNoAuth,
+			offered: []byte{socks5.MethodNoAuth},
+		},
+		{
+			name:     "user/pass",
+			username: []byte("user"),
+			password: []byte("pass"),
+			method:   socks5.MethodUserPass,
+			offered:  []byte{socks5.MethodUserPass},
+		},
+		{
+			name:    "no acceptable method",
+			method:  socks5.MethodNoAcceptable,
+			offered: []byte{socks5.MethodNoAuth},
+			err:     errNoAcceptableMethod,
+		},
+		{
+			name:     "method not offered",
+			username: []byte("user"),
+			password: []byte("pass"),
+			method:   socks5.MethodNoAuth,
+			offered:  []byte{socks5.MethodUserPass},
+			err:      errNoAcceptableMethod,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeSOCKS5{method: tt.method, username: "user", password: "pass", bound: boundIPv4}
+			addr := f.serve(t)
+
+			conn, err := NewSOCKS5(time.Second, time.Second).Dial([]byte("example.com:80"), addr, tt.username, tt.password)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Dial() error = %v, want %v", err, tt.err)
+			}
+			if err == nil {
+				conn.Close() //nolint:errcheck
+			}
+
+			if offered := <-f.methods; !bytes.Equal(offered, tt.offered) {
+				t.Errorf("offered methods = %v, want %v", offered, tt.offered)
+			}
+		})
+	}
+}
+
+func TestSOCKS5Auth(t *testing.T) {
+	tests := []struct {
+		name     string
+		password string
+		err      error
+	}{
+		{name: "success", password: "pass"},
+		{name: "wrong password", password: "wrong", err: errAuthFailed},
+		{name: "password too long", password: strings.Repeat("p", 256), err: errCredentialsTooLong},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeSOCKS5{method: socks5.MethodUserPass, username: "user", password: "pass", bound: boundIPv4}
+			addr := f.serve(t)
+
+			conn, err := NewSOCKS5(time.Second, time.Second).Dial([]byte("example.com:80"), addr, []byte("user"), []byte(tt.password))
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Dial() error = %v, want %v", err, tt.err)
+			}
+			if err == nil {
+				conn.Close() //nolint:errcheck
+			}
+		})
+	}
+}
+
+func TestSOCKS5Connect(t *testing.T) {
+	tests := []struct {
+		name    string
+		target  string
+		request []byte
+		bound   []byte
+		want    socks5.Addr
+	}{
+		{
+			name:    "ipv4",
+			target:  "1.2.3.4:80",
+			request: []byte{socks5.Version, socks5.CmdConnect, 0x00, socks5.AddrIPv4, 1, 2, 3, 4, 0x00, 0x50},
+			bound:   boundIPv4,
+			want:    socks5.Addr{Host: "10.0.0.1", Port: 1080},
+		},
+		{
+			name:   "ipv6",
+			target: "[2001:db8::1]:443",
+			request: []byte{socks5.Version, socks5.CmdConnect, 0x00, socks5.AddrIPv6,
+				0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x01, 0x01, 0xbb},
+			bound: []byte{socks5.AddrIPv6,
+				0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x02, 0x04, 0x38},
+			want: socks5.Addr{Host: "2001:db8::2", Port: 1080},
+		},
+		{
+			name:   "domain",
+			target: "example.com:8080",
+			request: append(append([]byte{socks5.Version, socks5.CmdConnect, 0x00, socks5.AddrDomain, 11},
+				"example.com"...), 0x1f, 0x90),
+			bound: append(append([]byte{socks5.AddrDomain, 9}, "proxy.lan"...), 0x04, 0x38),
+			want:  socks5.Addr{Host: "proxy.lan", Port: 1080},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeSOCKS5{method: socks5.MethodNoAuth, bound: tt.bound}
+			addr := f.serve(t)
+
+			target, err := socks5.ParseAddr(tt.target)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			conn, bound, err := NewSOCKS5(time.Second, time.Second).handshake(socks5.CmdConnect, target, addr, nil, nil)
+			if err != nil {
+				t.Fatalf("handshake() error = %v", err)
+			}
+			defer conn.Close() //nolint:errcheck
+
+			if request := <-f.request; !bytes.Equal(request, tt.request) {
+				t.Errorf("request = %v, want %v", request, tt.request)
+			}
+
+			if *bound != tt.want {
+				t.Errorf("bound = %v, want %v", bound, tt.want)
+			}
+
+			// the connection carries the stream once the reply is read
+			if _, err = conn.Write([]byte("ping")); err != nil {
+				t.Fatal(err)
+			}
+
+			echo := make([]byte, 4)
+			if _, err = io.ReadFull(conn, echo); err != nil || string(echo) != "ping" {
+				t.Errorf("echo = %q, %v", echo, err)
+			}
+		})
+	}
+}
+
+func TestSOCKS5ReplyErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		version byte
+		reply   byte
+		err     error
+	}{
+		{name: "general failure", reply: socks5.ReplyGeneralFailure, err: errReplyFailed},
+		{name: "not allowed", reply: socks5.ReplyNotAllowed, err: errReplyFailed},
+		{name: "network unreachable", reply: socks5.ReplyNetworkUnreachable, err: errTargetUnreachable},
+		{name: "host unreachable", reply: socks5.ReplyHostUnreachable, err: errTargetUnreachable},
+		{name: "connection refused", reply: socks5.ReplyConnectionRefused, err: errTargetUnreachable},
+		{name: "ttl expired", reply: socks5.ReplyTTLExpired, err: errTargetUnreachable},
+		{name: "command not supported", reply: socks5.ReplyCommandNotSupported, err: errReplyFailed},
+		{name: "address not supported", reply: socks5.ReplyAddrNotSupported, err: errReplyFailed},
+		{name: "invalid version", version: 0x04, reply: socks5.ReplySucceeded, err: socks5.ErrInvalidVersion},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeSOCKS5{method: socks5.MethodNoAuth, version: tt.version, reply: tt.reply, bound: boundIPv4}
+			addr := f.serve(t)
+
+			conn, err := NewSOCKS5(time.Second, time.Second).Dial([]byte("example.com:80"), addr, nil, nil)
+			if !errors.Is(err, tt.err) {
+				if err == nil {
+					conn.Close() //nolint:errcheck
+				}
+				t.Fatalf("Dial() error = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestSOCKS5PacketConn(t *testing.T) {
+	local, relay := net.Pipe()
+	pc := &socks5PacketConn{Conn: local}
+	defer relay.Close() //nolint:errcheck
+
+	target, err := socks5.ParseAddr("1.2.3.4:53")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the reused buffers must not leak a longer datagram into a shorter one
+	for _, payload := range []string{"a longer datagram", "short"} {
+		go pc.WriteTo([]byte(payload), target) //nolint:errcheck
+
+		buf := make([]byte, 1024)
+		n, err := relay.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, addr, data, err := socks5.ParseDatagram(buf[:n])
+		if err != nil {
+			t.Fatalf("ParseDatagram() error = %v", err)
+		}
+		if *addr != *target || string(data) != payload {
+			t.Errorf("relayed %v %q, want %v %q", addr, data, target, payload)
+		}
+
+		go relay.Write(buf[:n]) //nolint:errcheck
+
+		out := make([]byte, 1024)
+		n, from, err := pc.ReadFrom(out)
+		if err != nil {
+			t.Fatalf("ReadFrom() error = %v", err)
+		}
+		if from.String() != target.String() || string(out[:n]) != payload {
+			t.Errorf("ReadFrom() = %v %q, want %v %q", from, out[:n], target, payload)
+		}
+	}
+}
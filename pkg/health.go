@@ -0,0 +1,40 @@
+package pkg
+
+import (
+	"errors"
+)
+
+var (
+	// ErrTargetRefused - the upstream answered but refused or could not reach the target
+	ErrTargetRefused = errors.New("target refused by the upstream")
+)
+
+// Health - passive and active health of upstream providers
+type Health interface {
+	//Success - record a successful upstream attempt
+	Success(Provider)
+
+	//Failure - record a failed upstream attempt
+	Failure(Provider)
+
+	//Available - false while the provider circuit is open, must not change the circuit state
+	Available(Provider) bool
+
+	//Reserve - claim the provider picked for a request, false when its half-open trial is already taken
+	Reserve(Provider) bool
+}
+
+// reportHealth - feed the outcome of an upstream attempt to the health tracker
+func (p *Proxy) reportHealth(provider Provider, err error) {
+	if p.config.Health == nil || provider == nil {
+		return
+	}
+
+	// A refused target is the answer of a working upstream,
+	// a client dialing a dead host must not open the circuit shared by everyone
+	if err != nil && !errors.Is(err, ErrTargetRefused) {
+		p.config.Health.Failure(provider)
+	} else {
+		p.config.Health.Success(provider)
+	}
+}
@@ -0,0 +1,253 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/omimic12/proxy-server/pkg"
+	"go.uber.org/zap"
+)
+
+type State string
+
+const (
+	StateClosed   State = "closed"
+	StateOpen     State = "open"
+	StateHalfOpen State = "half_open"
+)
+
+const (
+	probeConcurrency = 16
+)
+
+// Breaker - per provider circuit breaker fed by request outcomes and an optional prober
+type Breaker struct {
+	mu        sync.Mutex
+	providers map[pkg.Provider]*circuit
+
+	failureThreshold int
+	openTimeout      time.Duration
+
+	logger *zap.Logger
+}
+
+type circuit struct {
+	label    string
+	state    State
+	failures int
+	since    time.Time
+	// trial - when the single half-open attempt was handed out
+	trial time.Time
+}
+
+// ProviderHealth - health of one provider as published for dashboards
+type ProviderHealth struct {
+	Provider string    `json:"provider"`
+	State    State     `json:"state"`
+	Failures int       `json:"failures"`
+	Since    time.Time `json:"since"`
+}
+
+func NewBreaker(failureThreshold int, openTimeout time.Duration, logger *zap.Logger) *Breaker {
+	return &Breaker{
+		providers:        make(map[pkg.Provider]*circuit),
+		failureThreshold: failureThreshold,
+		openTimeout:      openTimeout,
+		logger:           logger,
+	}
+}
+
+func (b *Breaker) Success(p pkg.Provider) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c := b.circuit(p)
+	if c.state != StateClosed {
+		b.logger.Info("provider circuit closed", zap.String("provider", c.label))
+		c.state = StateClosed
+		c.since = time.Now()
+	}
+	c.failures = 0
+}
+
+func (b *Breaker) Failure(p pkg.Provider) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c := b.circuit(p)
+	c.failures++
+
+	switch c.state {
+	case StateClosed:
+		if c.failures < b.failureThreshold {
+			return
+		}
+	case StateOpen:
+		return
+	}
+
+	b.logger.Warn("provider circuit opened", zap.String("provider", c.label), zap.Int("failures", c.failures))
+	c.state = StateOpen
+	c.since = time.Now()
+}
+
+// Available - whether the provider may be selected, free of side effects so it can filter candidates
+func (b *Breaker) Available(p pkg.Provider) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c, ok := b.providers[p]
+	if !ok {
+		return true
+	}
+
+	return b.admits(c, time.Now())
+}
+
+// Reserve - claim the selected provider, a recovering circuit hands out its single trial attempt here
+func (b *Breaker) Reserve(p pkg.Provider) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c, ok := b.providers[p]
+	if !ok {
+		return true
+	}
+
+	now := time.Now()
+	if !b.admits(c, now) {
+		return false
+	}
+
+	switch c.state {
+	case StateOpen:
+		c.state = StateHalfOpen
+		c.since = now
+	case StateHalfOpen:
+	default:
+		return true
+	}
+
+	c.trial = now
+	return true
+}
+
+func (b *Breaker) admits(c *circuit, now time.Time) bool {
+	switch c.state {
+	case StateOpen:
+		return now.Sub(c.since) >= b.openTimeout
+	case StateHalfOpen:
+		// a trial which never reported back does not keep the circuit half-open forever
+		return now.Sub(c.trial) >= b.openTimeout
+	}
+	return true
+}
+
+// Forget - drop the state of a provider removed from the pool
+func (b *Breaker) Forget(p pkg.Provider) {
+	b.mu.Lock()
+	delete(b.providers, p)
+	b.mu.Unlock()
+}
+
+func (b *Breaker) Snapshot() []ProviderHealth {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	snapshot := make([]ProviderHealth, 0, len(b.providers))
+	for _, c := range b.providers {
+		snapshot = append(snapshot, ProviderHealth{
+			Provider: c.label,
+			State:    c.state,
+			Failures: c.failures,
+			Since:    c.since,
+		})
+	}
+
+	return snapshot
+}
+
+// Probe - periodically CONNECT through every provider to target
+func (b *Breaker) Probe(ctx context.Context, providers func() []pkg.Provider, target string, period time.Duration) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			var wg sync.WaitGroup
+			sem := make(chan struct{}, probeConcurrency)
+			for _, p := range providers() {
+				sem <- struct{}{}
+				wg.Add(1)
+				go func(p pkg.Provider) {
+					defer func() {
+						<-sem
+						wg.Done()
+					}()
+
+					conn, err := p.Dial([]byte(target), &pkg.Request{})
+					if err != nil {
+						b.Failure(p)
+						return
+					}
+					conn.Close() //nolint:errcheck
+					b.Success(p)
+				}(p)
+			}
+			wg.Wait()
+		}
+	}
+}
+
+// Publish - periodically publish the health snapshot
+func (b *Breaker) Publish(ctx context.Context, period time.Duration, channel string, client *redis.Client) error {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			data, err := json.Marshal(b.Snapshot())
+			if err != nil {
+				return err
+			}
+
+			err = client.Publish(context.Background(), channel, string(data)).Err()
+			if err != nil {
+				b.logger.Error("failed to publish providers health", zap.Error(err))
+			}
+		}
+	}
+}
+
+func (b *Breaker) circuit(p pkg.Provider) *circuit {
+	c, ok := b.providers[p]
+	if !ok {
+		c = &circuit{label: label(p), state: StateClosed, since: time.Now()}
+		b.providers[p] = c
+	}
+	return c
+}
+
+// label - human readable provider identity, name@gateway with the owning purchase for resellers
+func label(p pkg.Provider) string {
+	hostname, _, _, _, err := p.Credentials(&pkg.Request{})
+	if err != nil {
+		return p.Name()
+	}
+
+	l := p.Name() + "@" + hostname
+	if id := p.PurchasedBy(); id > 0 {
+		l += "#" + strconv.FormatUint(uint64(id), 10)
+	}
+	return l
+}
@@ -0,0 +1,55 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+)
+
+// fakeHealth - circuit opened by consecutive failures, as the breaker does
+type fakeHealth struct {
+	threshold int
+	failures  int
+}
+
+func (f *fakeHealth) Success(Provider) { f.failures = 0 }
+
+func (f *fakeHealth) Failure(Provider) { f.failures++ }
+
+func (f *fakeHealth) Available(Provider) bool { return f.failures < f.threshold }
+
+func (f *fakeHealth) Reserve(p Provider) bool { return f.Available(p) }
+
+type fakeProvider struct {
+	Provider
+}
+
+func TestReportHealth(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		available bool
+	}{
+		{name: "success", available: true},
+		{name: "target refused", err: fmt.Errorf("bad status code: %w", ErrTargetRefused), available: true},
+		{name: "transport error", err: io.ErrUnexpectedEOF, available: false},
+		{name: "upstream auth error", err: errors.New("proxy authentication required"), available: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			health := &fakeHealth{threshold: 3}
+			p := &Proxy{config: &Options{Health: health}}
+			provider := &fakeProvider{}
+
+			for i := 0; i < 10; i++ {
+				p.reportHealth(provider, tt.err)
+			}
+
+			if available := health.Available(provider); available != tt.available {
+				t.Errorf("Available() = %v, want %v", available, tt.available)
+			}
+		})
+	}
+}
@@ -3,7 +3,6 @@ package pkg
 import (
 	"bytes"
 	"encoding/base64"
-	"io"
 	"net"
 	"net/http"
 	"strings"
@@ -41,9 +40,12 @@ func parseRequest(hostname string, username []byte, password string, req *Reques
 		}
 	}
 
-	err := parser.Parse(username, req)
-	if err != nil {
-		return err
+	// clients authenticated by their IP send no username to parse
+	if username != nil {
+		err := parser.Parse(username, req)
+		if err != nil {
+			return err
+		}
 	}
 
 	req.ID = RequestKey(req.Password, uuid.New().String())
@@ -74,6 +76,7 @@ func parseBasicAuth(credentials []byte) (username []byte, password string, ok bo
 	return buf[:s], string(buf[s+1:]), true
 }
 
+// headerSize - size of the request headers, bodies are counted while they stream
 func headerSize(req *http.Request) int64 {
 	size := int64(0)
 
@@ -84,15 +87,5 @@ func headerSize(req *http.Request) int64 {
 		}
 	}
 
-	// Calculate size of the request body if available
-	if req.Body != nil {
-		bodyBytes, err := io.ReadAll(req.Body)
-		if err == nil {
-			size += int64(len(bodyBytes))
-			// Reset the body so it can be read again later
-			req.Body = io.NopCloser(bytes.NewReader(bodyBytes))
-		}
-	}
-
 	return size
 }
@@ -0,0 +1,53 @@
+package pkg
+
+import (
+	"context"
+)
+
+// Ledger - data balance of bandwidth limited purchases kept in real time
+type Ledger interface {
+	//Balance - remaining bytes of the password, seeded from the store when unknown
+	Balance(ctx context.Context, password string) (int64, error)
+
+	//Spend - take bytes from the balance of the password and return what is left
+	Spend(password string, bytes int64) int64
+
+	//Flushed - spent bytes of the password were handed to the accountant and are on their way to the store
+	Flushed(password string, bytes int64)
+}
+
+// outOfData - check the purchase has no data left, the balance is not enforced while the ledger fails
+func (p *Proxy) outOfData(ctx context.Context, purchase *Purchase, request *Request) bool {
+	if p.config.Ledger == nil || !purchase.BandwidthLimited || request.IP != nil {
+		return false
+	}
+
+	balance, err := p.config.Ledger.Balance(ctx, request.Password)
+	if err != nil {
+		p.logError(err, request)
+		return false
+	}
+
+	return balance <= 0
+}
+
+// spend - take bytes from the balance, every open connection of the password is terminated once it is exhausted
+func (m *meter) spend(n int64) {
+	if m.p.config.Ledger == nil || !m.purchase.BandwidthLimited || !m.account || n <= 0 {
+		return
+	}
+
+	// only the chunk crossing zero terminates, the ones still in flight find nothing left to do
+	if remaining := m.p.config.Ledger.Spend(m.password, n); remaining <= 0 && remaining+n > 0 {
+		m.p.config.ConnectionTracker.Terminate(m.password)
+	}
+}
+
+// flushed - tell the ledger the spending reported to the accountant no longer has to be held against the store
+func (m *meter) flushed(n int64) {
+	if m.p.config.Ledger == nil || n <= 0 {
+		return
+	}
+
+	m.p.config.Ledger.Flushed(m.password, n)
+}
@@ -0,0 +1,123 @@
+package ledger
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"go.uber.org/zap"
+)
+
+// Redis - local balances seeded from the data keys of the purchases.
+// Spending is local and synchronous, the accountant reports it and Reconcile
+// picks up the balance of the store, including spending of other instances and top ups.
+type Redis struct {
+	client   *redis.Client
+	balances sync.Map
+
+	logger *zap.Logger
+}
+
+type balance struct {
+	remaining atomic.Int64
+	// pending - bytes spent but not yet handed to the accountant, so not applied to the store
+	pending atomic.Int64
+	used    atomic.Bool
+}
+
+func NewRedis(client *redis.Client, logger *zap.Logger) *Redis {
+	return &Redis{client: client, logger: logger}
+}
+
+func (r *Redis) Balance(ctx context.Context, password string) (int64, error) {
+	if b, ok := r.balances.Load(password); ok {
+		b.(*balance).used.Store(true)
+		return b.(*balance).remaining.Load(), nil
+	}
+
+	value, err := r.fetch(ctx, password)
+	if err != nil {
+		return 0, err
+	}
+
+	b := new(balance)
+	b.remaining.Store(value)
+	b.used.Store(true)
+
+	actual, _ := r.balances.LoadOrStore(password, b)
+	return actual.(*balance).remaining.Load(), nil
+}
+
+func (r *Redis) Spend(password string, bytes int64) int64 {
+	b, ok := r.balances.Load(password)
+	if !ok {
+		// not seeded yet, the handler seeds it before the request is served
+		return 1
+	}
+
+	b.(*balance).pending.Add(bytes)
+	return b.(*balance).remaining.Add(-bytes)
+}
+
+func (r *Redis) Flushed(password string, bytes int64) {
+	b, ok := r.balances.Load(password)
+	if !ok {
+		return
+	}
+
+	// spending of a balance seeded after it was metered was never pending
+	pending := &b.(*balance).pending
+	for {
+		old := pending.Load()
+		if pending.CompareAndSwap(old, max(old-bytes, 0)) {
+			return
+		}
+	}
+}
+
+// Reconcile - reload the balances from the store every period until ctx is done,
+// balances not used since the previous reconcile are dropped
+func (r *Redis) Reconcile(ctx context.Context, period time.Duration) error {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			r.reconcile(ctx)
+		}
+	}
+}
+
+func (r *Redis) reconcile(ctx context.Context) {
+	r.balances.Range(func(key, value interface{}) bool {
+		password, b := key.(string), value.(*balance)
+
+		if !b.used.Swap(false) {
+			r.balances.Delete(password)
+			return true
+		}
+
+		stored, err := r.fetch(ctx, password)
+		if err != nil {
+			r.logger.Error("failed to reconcile data balance", zap.Error(err))
+			return true
+		}
+
+		// bytes not flushed yet are missing from the store, flushed ones are its business
+		b.remaining.Store(stored - b.pending.Load())
+		return true
+	})
+}
+
+func (r *Redis) fetch(ctx context.Context, password string) (int64, error) {
+	value, err := r.client.Get(ctx, password).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return value, err
+}
@@ -37,14 +37,23 @@ const (
 var (
 	Errors400BadRequest      = "proxy_errors_400"
 	Errors403Forbidden       = "proxy_errors_403"
+	Errors403PolicyDenied    = "proxy_errors_403_policy"
 	Errors407AuthRequired    = "proxy_errors_407"
 	Errors402PaymentRequired = "proxy_errors_402"
 	Errors429TooManyRequests = "proxy_errors_429"
 	Errors500Internal        = "proxy_errors_500"
 	Errors502Internal        = "proxy_errors_502"
+	Errors503NoLocation      = "proxy_errors_503_location"
 	Errors504GatewayTimeout  = "proxy_errors_504"
 )
 
+var (
+	ErrorsUsageOverflow    = "proxy_errors_usage_overflow"
+	ErrorsUsageDropped     = "proxy_errors_usage_dropped"
+	ErrorsUsagePublish     = "proxy_errors_usage_publish"
+	ErrorsUsageNotReceived = "proxy_errors_usage_not_received"
+)
+
 func NewInfluxDB(
 	ctx context.Context,
 	bufferSize int,
@@ -0,0 +1,50 @@
+package pkg
+
+// meter - batches the bytes moved in one direction of a request and reports
+// them to Measure and, for bandwidth limited purchases, to Accountant
+type meter struct {
+	p         *Proxy
+	purchase  *Purchase
+	password  string
+	account   bool
+	isRead    bool
+	accounted int64
+}
+
+func (p *Proxy) newMeter(purchase *Purchase, account, isRead bool, password string) *meter {
+	return &meter{
+		p:        p,
+		purchase: purchase,
+		password: password,
+		account:  account,
+		isRead:   isRead,
+	}
+}
+
+// add - count n bytes and report once AccountBytes are collected
+func (m *meter) add(n int64) (err error) {
+	m.spend(n)
+
+	m.accounted += n
+	if m.accounted >= m.p.config.AccountBytes {
+		err = m.flush()
+	}
+	return
+}
+
+// flush - report collected bytes
+func (m *meter) flush() (err error) {
+	if m.isRead {
+		err = m.p.config.Measure.IncReadBytes(m.password, m.accounted)
+	} else {
+		err = m.p.config.Measure.IncWriteBytes(m.password, m.accounted)
+	}
+
+	if m.purchase.BandwidthLimited && m.account {
+		err = m.p.config.Accountant.Decrement(m.password, m.accounted)
+		m.flushed(m.accounted)
+	}
+
+	m.accounted = 0
+	return
+}
@@ -0,0 +1,16 @@
+package pkg
+
+import (
+	"errors"
+)
+
+var (
+	ErrPortNotAllowed        = errors.New("port not allowed")
+	ErrDestinationNotAllowed = errors.New("destination not allowed")
+)
+
+// Policy - destination ports and addresses purchases may reach
+type Policy interface {
+	//Allow - check the purchase may connect to port of host, host is resolved when it is not an IP
+	Allow(purchase *Purchase, host string, port int) error
+}
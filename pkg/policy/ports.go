@@ -0,0 +1,205 @@
+package policy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bluele/gcache"
+	"github.com/omimic12/proxy-server/pkg"
+	"go.uber.org/zap"
+)
+
+var (
+	// sharedAddressSpace - carrier grade NAT, RFC 6598
+	sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0).To4(), Mask: net.CIDRMask(10, 32)}
+)
+
+// Ports - denied and per purchase type allowed ports, internal destinations are always denied
+type Ports struct {
+	denied  map[int]struct{}
+	allowed map[string][]portRange
+
+	// lookups - *resolved by host, failed lookups are kept for negativeTTL
+	lookups       gcache.Cache
+	lookup        func(ctx context.Context, host string) ([]net.IPAddr, error)
+	lookupTimeout time.Duration
+	positiveTTL   time.Duration
+	negativeTTL   time.Duration
+	// failClosed - deny destinations which can not be resolved instead of leaving them to the upstream
+	failClosed bool
+
+	logger *zap.Logger
+}
+
+// resolved - outcome of a destination lookup
+type resolved struct {
+	ips []net.IP
+	err error
+}
+
+type portRange struct {
+	from, to int
+}
+
+// NewPorts - denied is a port list like "25,465,587",
+// allowed lists port ranges per purchase type like "static:1-65535;provider:80,443,1024-65535"
+func NewPorts(
+	denied, allowed string,
+	lookupTimeout time.Duration,
+	lookupCacheSize int,
+	positiveTTL, negativeTTL time.Duration,
+	failClosed bool,
+	logger *zap.Logger,
+) (*Ports, error) {
+	p := &Ports{
+		denied:        make(map[int]struct{}),
+		allowed:       make(map[string][]portRange),
+		lookups:       gcache.New(lookupCacheSize).LRU().Build(),
+		lookup:        net.DefaultResolver.LookupIPAddr,
+		lookupTimeout: lookupTimeout,
+		positiveTTL:   positiveTTL,
+		negativeTTL:   negativeTTL,
+		failClosed:    failClosed,
+		logger:        logger,
+	}
+
+	ranges, err := parseRanges(denied)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range ranges {
+		for port := r.from; port <= r.to; port++ {
+			p.denied[port] = struct{}{}
+		}
+	}
+
+	for _, rule := range strings.Split(allowed, ";") {
+		if strings.TrimSpace(rule) == "" {
+			continue
+		}
+
+		t, list, ok := strings.Cut(rule, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid allowed ports %q", rule)
+		}
+
+		ranges, err := parseRanges(list)
+		if err != nil {
+			return nil, err
+		}
+		p.allowed[strings.TrimSpace(t)] = ranges
+	}
+
+	return p, nil
+}
+
+func (p *Ports) Allow(purchase *pkg.Purchase, host string, port int) error {
+	if _, ok := p.denied[port]; ok {
+		return pkg.ErrPortNotAllowed
+	}
+
+	// Purchase types without rules may use any port which is not denied
+	if ranges, ok := p.allowed[purchase.Type]; ok && !contains(ranges, port) {
+		return pkg.ErrPortNotAllowed
+	}
+
+	ips, err := p.resolve(host)
+	if err != nil {
+		p.logger.Debug("failed to resolve destination", zap.String("host", host), zap.Error(err))
+		if p.failClosed {
+			return pkg.ErrDestinationNotAllowed
+		}
+		// the upstream resolves the host on its own
+		return nil
+	}
+
+	for _, ip := range ips {
+		if internal(ip) {
+			return pkg.ErrDestinationNotAllowed
+		}
+	}
+
+	return nil
+}
+
+func (p *Ports) resolve(host string) ([]net.IP, error) {
+	if ip := net.ParseIP(strings.Trim(host, "[]")); ip != nil {
+		return []net.IP{ip}, nil
+	}
+
+	if value, err := p.lookups.Get(host); err == nil {
+		r := value.(*resolved)
+		return r.ips, r.err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.lookupTimeout)
+	defer cancel()
+
+	r := &resolved{}
+	addrs, err := p.lookup(ctx, host)
+	if err != nil {
+		r.err = err
+		p.lookups.SetWithExpire(host, r, p.negativeTTL) //nolint:errcheck
+		return nil, err
+	}
+
+	r.ips = make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		r.ips = append(r.ips, addr.IP)
+	}
+	p.lookups.SetWithExpire(host, r, p.positiveTTL) //nolint:errcheck
+	return r.ips, nil
+}
+
+// internal - private, loopback, link-local and other addresses not reachable on the internet
+func internal(ip net.IP) bool {
+	return ip.IsPrivate() ||
+		ip.IsLoopback() ||
+		ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() ||
+		ip.IsUnspecified() ||
+		sharedAddressSpace.Contains(ip)
+}
+
+func contains(ranges []portRange, port int) bool {
+	for _, r := range ranges {
+		if port >= r.from && port <= r.to {
+			return true
+		}
+	}
+	return false
+}
+
+// parseRanges - parse a list like "80,443,1024-65535"
+func parseRanges(list string) ([]portRange, error) {
+	var ranges []portRange
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		from, to, isRange := strings.Cut(item, "-")
+		if !isRange {
+			to = from
+		}
+
+		f, err := strconv.Atoi(strings.TrimSpace(from))
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q", item)
+		}
+
+		t, err := strconv.Atoi(strings.TrimSpace(to))
+		if err != nil || t < f {
+			return nil, fmt.Errorf("invalid port range %q", item)
+		}
+
+		ranges = append(ranges, portRange{from: f, to: t})
+	}
+	return ranges, nil
+}
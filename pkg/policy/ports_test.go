@@ -0,0 +1,59 @@
+package policy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/omimic12/proxy-server/pkg"
+	"go.uber.org/zap"
+)
+
+func TestPortsLookup(t *testing.T) {
+	tests := []struct {
+		name       string
+		host       string
+		failClosed bool
+		err        error
+	}{
+		{name: "public destination", host: "public.example"},
+		{name: "internal destination", host: "internal.example", err: pkg.ErrDestinationNotAllowed},
+		{name: "unresolved destination fails open", host: "missing.example"},
+		{name: "unresolved destination fails closed", host: "missing.example", failClosed: true, err: pkg.ErrDestinationNotAllowed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := NewPorts("25", "", time.Second, 10, time.Minute, time.Minute, tt.failClosed, zap.NewNop())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			lookups := 0
+			p.lookup = func(_ context.Context, host string) ([]net.IPAddr, error) {
+				lookups++
+				switch host {
+				case "public.example":
+					return []net.IPAddr{{IP: net.ParseIP("93.184.216.34")}}, nil
+				case "internal.example":
+					return []net.IPAddr{{IP: net.ParseIP("10.0.0.1")}}, nil
+				}
+				return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+			}
+
+			purchase := &pkg.Purchase{Type: "static"}
+			for i := 0; i < 3; i++ {
+				if err = p.Allow(purchase, tt.host, 443); !errors.Is(err, tt.err) {
+					t.Fatalf("Allow() error = %v, want %v", err, tt.err)
+				}
+			}
+
+			// successful and failed lookups are both served from the cache
+			if lookups != 1 {
+				t.Errorf("lookups = %d, want 1", lookups)
+			}
+		})
+	}
+}
@@ -1,6 +1,9 @@
 package pkg
 
-import "net"
+import (
+	"errors"
+	"net"
+)
 
 const (
 	ProviderStatic      = "static"
@@ -16,6 +19,11 @@ var (
 	Rotating        Feature = []byte("rotating")
 	Sticky          Feature = []byte("sticky")
 	SessionDuration Feature = []byte("duration")
+	UDP             Feature = []byte("udp")
+)
+
+var (
+	ErrUDPNotSupported = errors.New("provider does not support udp")
 )
 
 type Route string
@@ -25,6 +33,8 @@ const (
 	RouteCountry   Route = "country"
 	RouteRegion    Route = "region"
 	RouteCity      Route = "city"
+	RouteZip       Route = "zip"
+	RouteASN       Route = "asn"
 )
 
 type Provider interface {
@@ -39,6 +49,8 @@ type Provider interface {
 	HasCountry(country string) bool
 	HasRegion(region string) bool
 	HasCity(city string) bool
+	HasASN(asn uint) bool
+	HasISP(isp string) bool
 
 	BandwidthLimit() int64
 
@@ -48,3 +60,8 @@ type Provider interface {
 
 	PurchasedBy() uint
 }
+
+// PacketProvider - implemented by providers able to relay UDP datagrams
+type PacketProvider interface {
+	DialPacket(*Request) (net.PacketConn, error)
+}
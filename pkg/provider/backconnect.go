@@ -1,6 +1,7 @@
 package provider
 
 import (
+	"bytes"
 	"encoding/base64"
 	"net"
 
@@ -17,7 +18,7 @@ type Backconnect struct {
 	weight   uint64
 	protocol pkg.Protocol
 	dialer   pkg.Dialer
-	region   string
+	location Location
 }
 
 func NewBackconnect(
@@ -28,7 +29,7 @@ func NewBackconnect(
 	provider string,
 	protocol pkg.Protocol,
 	dialer pkg.Dialer,
-	region string,
+	location Location,
 ) (*Backconnect, error) {
 	buf := bytebufferpool.Get()
 	defer bytebufferpool.Put(buf)
@@ -49,7 +50,7 @@ func NewBackconnect(
 		encoded:  encoded,
 		weight:   weight,
 		dialer:   dialer,
-		region: region,
+		location: location,
 	}, nil
 }
 
@@ -65,20 +66,42 @@ func (s *Backconnect) Weight() uint64 {
 	return s.weight
 }
 
-func (s *Backconnect) HasCountry(_ string) bool {
-	return true
+func (s *Backconnect) HasCountry(country string) bool {
+	return s.location.HasCountry(country)
 }
 
 func (s *Backconnect) HasRegion(region string) bool {
-	return s.region == region
+	return s.location.HasRegion(region)
 }
 
-func (s *Backconnect) HasCity(_ string) bool {
-	return false
+func (s *Backconnect) HasCity(city string) bool {
+	return s.location.HasCity(city)
 }
 
-func (s *Backconnect) HasFeatures(_ ...pkg.Feature) bool {
-	return false
+func (s *Backconnect) HasASN(asn uint) bool {
+	return s.location.HasASN(asn)
+}
+
+func (s *Backconnect) HasISP(isp string) bool {
+	return s.location.HasISP(isp)
+}
+
+func (s *Backconnect) HasFeatures(features ...pkg.Feature) bool {
+	if len(features) == 0 {
+		return false
+	}
+
+	for _, feature := range features {
+		if !bytes.Equal(feature, pkg.UDP) {
+			return false
+		}
+
+		if _, ok := s.dialer.(pkg.PacketDialer); !ok {
+			return false
+		}
+	}
+
+	return true
 }
 
 func (s *Backconnect) HasRoutes(_ ...pkg.Route) bool {
@@ -97,6 +120,15 @@ func (s *Backconnect) Dial(uri []byte, _ *pkg.Request) (rc net.Conn, err error)
 	return s.dialer.Dial(uri, s.addr, s.username, s.password)
 }
 
+func (s *Backconnect) DialPacket(_ *pkg.Request) (net.PacketConn, error) {
+	d, ok := s.dialer.(pkg.PacketDialer)
+	if !ok {
+		return nil, pkg.ErrUDPNotSupported
+	}
+
+	return d.DialPacket(s.addr, s.username, s.password)
+}
+
 func (s *Backconnect) PurchasedBy() uint {
 	return 0
 }
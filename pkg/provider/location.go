@@ -0,0 +1,39 @@
+package provider
+
+import (
+	"strings"
+)
+
+// Location - where the exit IP of a proxy is, unknown fields are empty and match no targeting
+type Location struct {
+	Country string
+	Region  string
+	City    string
+	ASN     uint
+	ISP     string
+}
+
+func (l Location) HasCountry(country string) bool {
+	return strings.EqualFold(l.Country, country)
+}
+
+func (l Location) HasRegion(region string) bool {
+	return sameName(l.Region, region)
+}
+
+func (l Location) HasCity(city string) bool {
+	return sameName(l.City, city)
+}
+
+func (l Location) HasASN(asn uint) bool {
+	return l.ASN != 0 && l.ASN == asn
+}
+
+func (l Location) HasISP(isp string) bool {
+	return sameName(l.ISP, isp)
+}
+
+// sameName - compare names case insensitively, usernames write spaces as underscores
+func sameName(name, targeted string) bool {
+	return strings.EqualFold(name, strings.ReplaceAll(targeted, "_", " "))
+}
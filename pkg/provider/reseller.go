@@ -0,0 +1,265 @@
+package provider
+
+import (
+	"encoding/base64"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/omimic12/proxy-server/pkg"
+	"github.com/valyala/bytebufferpool"
+)
+
+var (
+	byteColon = []byte(":")
+)
+
+var (
+	ErrUnknownReseller = errors.New("unknown reseller")
+)
+
+// Reseller - gateway of a reseller, the username carrying the targeting is built from the reseller template.
+// The template is looked up on every use so template changes apply to open purchases.
+type Reseller struct {
+	templates *Templates
+	name      string
+	username  []byte
+	password  []byte
+	weight    uint64
+	protocol  pkg.Protocol
+	dialer    pkg.Dialer
+
+	purchaseId uint
+
+	// gateway - round robin position over the gateways of the template
+	gateway atomic.Uint64
+}
+
+func NewReseller(
+	templates *Templates,
+	name string,
+	username []byte,
+	password []byte,
+	weight uint64,
+	protocol pkg.Protocol,
+	dialer pkg.Dialer,
+	purchaseId uint,
+) (*Reseller, error) {
+	if templates.Get(name) == nil {
+		return nil, ErrUnknownReseller
+	}
+
+	return &Reseller{
+		templates:  templates,
+		name:       name,
+		username:   username,
+		password:   password,
+		weight:     weight,
+		protocol:   protocol,
+		dialer:     dialer,
+		purchaseId: purchaseId,
+	}, nil
+}
+
+func (s *Reseller) Name() string {
+	return s.name
+}
+
+func (s *Reseller) Protocol() pkg.Protocol {
+	return s.protocol
+}
+
+func (s *Reseller) Weight() uint64 {
+	return s.weight
+}
+
+func (s *Reseller) HasCountry(_ string) bool {
+	return s.HasRoutes(pkg.RouteCountry)
+}
+
+func (s *Reseller) HasRegion(_ string) bool {
+	return s.HasRoutes(pkg.RouteRegion)
+}
+
+func (s *Reseller) HasCity(_ string) bool {
+	return s.HasRoutes(pkg.RouteCity)
+}
+
+func (s *Reseller) HasASN(_ uint) bool {
+	return s.HasRoutes(pkg.RouteASN)
+}
+
+func (s *Reseller) HasISP(_ string) bool {
+	return s.has(placeholderISP)
+}
+
+func (s *Reseller) HasFeatures(features ...pkg.Feature) bool {
+	for _, feature := range features {
+		switch {
+		case string(feature) == string(pkg.Rotating):
+		case string(feature) == string(pkg.Sticky) && s.has(placeholderSession):
+		case string(feature) == string(pkg.SessionDuration) && s.has(placeholderDuration):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Reseller) HasRoutes(levels ...pkg.Route) bool {
+	for _, level := range levels {
+		if !s.has(string(level)) {
+			return false
+		}
+	}
+	return true
+}
+
+// has - check the template has a parameter for the placeholder
+func (s *Reseller) has(placeholder string) bool {
+	template := s.templates.Get(s.name)
+	if template == nil {
+		return false
+	}
+
+	for _, param := range template.Params {
+		if param.Value == placeholder {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Reseller) BandwidthLimit() int64 {
+	return -1
+}
+
+func (s *Reseller) Credentials(request *pkg.Request) (string, []byte, []byte, []byte, error) {
+	template := s.templates.Get(s.name)
+	if template == nil {
+		return "", nil, nil, nil, ErrUnknownReseller
+	}
+
+	buf := bytebufferpool.Get()
+	defer bytebufferpool.Put(buf)
+
+	template.buildUsername(buf, s.username, request)
+
+	// the buffer goes back to the pool, the username must not share it
+	username := append([]byte(nil), buf.Bytes()...)
+	buf.Write(byteColon)  //nolint:errcheck
+	buf.Write(s.password) //nolint:errcheck
+
+	cc := make([]byte, base64.StdEncoding.EncodedLen(buf.Len()))
+	base64.StdEncoding.Encode(cc, buf.Bytes())
+
+	return s.gatewayOf(template, request), username, s.password, cc, nil
+}
+
+func (s *Reseller) Dial(uri []byte, request *pkg.Request) (rc net.Conn, err error) {
+	template := s.templates.Get(s.name)
+	if template == nil {
+		return nil, ErrUnknownReseller
+	}
+
+	username := bytebufferpool.Get()
+	defer bytebufferpool.Put(username)
+
+	template.buildUsername(username, s.username, request)
+
+	return s.dialer.Dial(uri, s.gatewayOf(template, request), username.Bytes(), s.password)
+}
+
+// gatewayOf - sticky sessions keep their gateway, other requests rotate across them
+func (s *Reseller) gatewayOf(template *Template, request *pkg.Request) string {
+	if len(template.Gateways) == 1 {
+		return template.Gateways[0]
+	}
+
+	if request.SessionID != "" {
+		session, err := strconv.ParseUint(request.SessionID, 10, 64)
+		if err == nil {
+			return template.Gateways[session%uint64(len(template.Gateways))]
+		}
+	}
+
+	return template.Gateways[(s.gateway.Add(1)-1)%uint64(len(template.Gateways))]
+}
+
+func (s *Reseller) PurchasedBy() uint {
+	return s.purchaseId
+}
+
+// buildUsername - login, then the parameters with a value joined by the separator
+func (t *Template) buildUsername(username *bytebufferpool.ByteBuffer, login []byte, request *pkg.Request) {
+	if !t.OmitLogin {
+		username.Write(login) //nolint:errcheck
+	}
+
+	written := false
+	for _, param := range t.Params {
+		value := param.value(request)
+		if value == "" {
+			continue
+		}
+
+		if written {
+			username.WriteString(t.Separator) //nolint:errcheck
+		} else if username.Len() > 0 {
+			username.WriteString(t.Prefix) //nolint:errcheck
+		}
+		written = true
+
+		username.WriteString(param.Key) //nolint:errcheck
+		username.WriteString(value)     //nolint:errcheck
+	}
+}
+
+// value - the request value of the placeholder with the case and unit of the parameter, the default when empty
+func (p *Param) value(request *pkg.Request) string {
+	var value string
+	switch p.Value {
+	case string(pkg.RouteContinent):
+		value = string(request.Continent)
+	case string(pkg.RouteCountry):
+		value = string(request.Country)
+	case string(pkg.RouteRegion):
+		value = string(request.Region)
+	case string(pkg.RouteCity):
+		value = string(request.City)
+	case string(pkg.RouteZip):
+		value = string(request.Zip)
+	case string(pkg.RouteASN):
+		if request.ASN != 0 {
+			value = strconv.FormatUint(uint64(request.ASN), 10)
+		}
+	case placeholderISP:
+		value = string(request.ISP)
+	case placeholderSession:
+		value = request.SessionID
+	case placeholderDuration:
+		if request.SessionDuration > 0 {
+			if p.Unit == unitMinutes {
+				// at least a minute, a shorter session would not be sticky at all
+				value = strconv.Itoa(max(1, int(request.SessionDuration.Minutes())))
+			} else {
+				value = strconv.Itoa(int(request.SessionDuration.Seconds()))
+			}
+		}
+	}
+
+	if value == "" {
+		return p.Default
+	}
+
+	switch p.Case {
+	case caseUpper:
+		return strings.ToUpper(value)
+	case caseLower:
+		return strings.ToLower(value)
+	default:
+		return value
+	}
+}
@@ -1,6 +1,7 @@
 package provider
 
 import (
+	"bytes"
 	"encoding/base64"
 	"net"
 
@@ -17,6 +18,7 @@ type Static struct {
 	weight   uint64
 	protocol pkg.Protocol
 	dialer   pkg.Dialer
+	location Location
 }
 
 func NewStatic(
@@ -27,6 +29,7 @@ func NewStatic(
 	provider string,
 	protocol pkg.Protocol,
 	dialer pkg.Dialer,
+	location Location,
 ) (*Static, error) {
 	buf := bytebufferpool.Get()
 	defer bytebufferpool.Put(buf)
@@ -47,6 +50,7 @@ func NewStatic(
 		encoded:  encoded,
 		weight:   weight,
 		dialer:   dialer,
+		location: location,
 	}, nil
 }
 
@@ -62,20 +66,42 @@ func (s *Static) Weight() uint64 {
 	return s.weight
 }
 
-func (s *Static) HasCountry(_ string) bool {
-	return true
+func (s *Static) HasCountry(country string) bool {
+	return s.location.HasCountry(country)
 }
 
-func (s *Static) HasRegion(_ string) bool {
-	return false
+func (s *Static) HasRegion(region string) bool {
+	return s.location.HasRegion(region)
 }
 
-func (s *Static) HasCity(_ string) bool {
-	return false
+func (s *Static) HasCity(city string) bool {
+	return s.location.HasCity(city)
 }
 
-func (s *Static) HasFeatures(_ ...pkg.Feature) bool {
-	return false
+func (s *Static) HasASN(asn uint) bool {
+	return s.location.HasASN(asn)
+}
+
+func (s *Static) HasISP(isp string) bool {
+	return s.location.HasISP(isp)
+}
+
+func (s *Static) HasFeatures(features ...pkg.Feature) bool {
+	if len(features) == 0 {
+		return false
+	}
+
+	for _, feature := range features {
+		if !bytes.Equal(feature, pkg.UDP) {
+			return false
+		}
+
+		if _, ok := s.dialer.(pkg.PacketDialer); !ok {
+			return false
+		}
+	}
+
+	return true
 }
 
 func (s *Static) HasRoutes(_ ...pkg.Route) bool {
@@ -94,6 +120,15 @@ func (s *Static) Dial(uri []byte, _ *pkg.Request) (rc net.Conn, err error) {
 	return s.dialer.Dial(uri, s.addr, s.username, s.password)
 }
 
+func (s *Static) DialPacket(_ *pkg.Request) (net.PacketConn, error) {
+	d, ok := s.dialer.(pkg.PacketDialer)
+	if !ok {
+		return nil, pkg.ErrUDPNotSupported
+	}
+
+	return d.DialPacket(s.addr, s.username, s.password)
+}
+
 func (s *Static) PurchasedBy() uint {
 	return 0
 }
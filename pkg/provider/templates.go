@@ -0,0 +1,253 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/omimic12/proxy-server/pkg"
+	"go.uber.org/zap"
+)
+
+const (
+	placeholderISP      = "isp"
+	placeholderSession  = "session"
+	placeholderDuration = "duration"
+
+	caseUpper = "upper"
+	caseLower = "lower"
+
+	unitSeconds = "s"
+	unitMinutes = "m"
+)
+
+// Template - how a reseller gateway expects the targeting in the username
+type Template struct {
+	Name     string   `json:"name"`
+	Gateways []string `json:"gateways"`
+
+	// OmitLogin - the username is made of the parameters only
+	OmitLogin bool `json:"omit_login"`
+
+	// Prefix - between the login and the first parameter, Separator - between parameters
+	Prefix    string `json:"prefix"`
+	Separator string `json:"separator"`
+
+	// Params - written in order, the ones without a value are left out.
+	// Targeting and features are supported as far as a parameter carries them.
+	Params []Param `json:"params"`
+}
+
+// Param - key followed by the value of a placeholder:
+// continent, country, region, city, zip, asn, isp, session or duration
+type Param struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+
+	// Case - upper or lower, the value is kept as requested when empty
+	Case string `json:"case"`
+
+	// Unit - s or m for the duration, seconds when empty
+	Unit string `json:"unit"`
+
+	// Default - written when the request has no value
+	Default string `json:"default"`
+}
+
+// DefaultTemplates - resellers supported out of the box, a template of the same name loaded later replaces them
+func DefaultTemplates() []*Template {
+	return []*Template{
+		{
+			Name:      pkg.ProviderTTProxy,
+			Gateways:  []string{"dynamic.ttproxy.com:10001"},
+			Prefix:    "-",
+			Separator: "-",
+			Params: []Param{
+				{Key: "cc-", Value: string(pkg.RouteCountry), Case: caseUpper},
+				{Key: "state-", Value: string(pkg.RouteRegion), Case: caseLower},
+				{Key: "city-", Value: string(pkg.RouteCity), Case: caseLower},
+				{Key: "session-", Value: placeholderSession},
+				{Key: "sessTime-", Value: placeholderDuration, Unit: unitMinutes},
+			},
+		},
+		{
+			Name:      pkg.ProviderDataImpulse,
+			Gateways:  []string{"gw.dataimpulse.com:823"},
+			Prefix:    "__",
+			Separator: ";",
+			Params: []Param{
+				{Key: "cr.", Value: string(pkg.RouteCountry), Case: caseLower},
+				{Key: "state.", Value: string(pkg.RouteRegion), Case: caseLower},
+				{Key: "city.", Value: string(pkg.RouteCity), Case: caseLower},
+				{Key: "zip.", Value: string(pkg.RouteZip)},
+				{Key: "asn.", Value: string(pkg.RouteASN)},
+				{Key: "sessid.", Value: placeholderSession},
+				{Key: "sessttl.", Value: placeholderDuration, Unit: unitMinutes},
+			},
+		},
+		{
+			Name:      pkg.ProviderProxyverse,
+			Gateways:  []string{"51.81.93.42:9200"},
+			OmitLogin: true,
+			Prefix:    "-",
+			Separator: "-",
+			Params: []Param{
+				{Key: "country-", Value: string(pkg.RouteCountry), Case: caseLower, Default: "worldwide"},
+				{Key: "continent-", Value: string(pkg.RouteContinent), Case: caseLower},
+				{Key: "region-", Value: string(pkg.RouteRegion), Case: caseLower},
+				{Key: "city-", Value: string(pkg.RouteCity), Case: caseLower},
+				{Key: "zip-", Value: string(pkg.RouteZip)},
+				{Key: "asn-", Value: string(pkg.RouteASN)},
+				{Key: "session-", Value: placeholderSession},
+				{Key: "duration-", Value: placeholderDuration, Unit: unitSeconds},
+			},
+		},
+		{
+			Name:      pkg.ProviderDatabay,
+			Gateways:  []string{"resi-global-gateways.databay.com:7676"},
+			Prefix:    "-",
+			Separator: "-",
+			Params: []Param{
+				{Key: "countryCode-", Value: string(pkg.RouteCountry), Case: caseUpper},
+				{Key: "continent-", Value: string(pkg.RouteContinent), Case: caseLower},
+				{Key: "stateCode-", Value: string(pkg.RouteRegion), Case: caseUpper},
+				{Key: "city-", Value: string(pkg.RouteCity), Case: caseLower},
+				{Key: "zipCode-", Value: string(pkg.RouteZip)},
+				{Key: "asn-", Value: string(pkg.RouteASN)},
+				{Key: "sessionId-", Value: placeholderSession},
+				{Key: "sessionMaxDuration-", Value: placeholderDuration, Unit: unitMinutes},
+			},
+		},
+	}
+}
+
+// Validate - check the template can build usernames
+func (t *Template) Validate() error {
+	if t.Name == "" {
+		return fmt.Errorf("reseller template without name")
+	}
+
+	if len(t.Gateways) == 0 {
+		return fmt.Errorf("reseller template %s without gateways", t.Name)
+	}
+
+	for _, param := range t.Params {
+		switch param.Value {
+		case string(pkg.RouteContinent), string(pkg.RouteCountry), string(pkg.RouteRegion), string(pkg.RouteCity),
+			string(pkg.RouteZip), string(pkg.RouteASN), placeholderISP, placeholderSession, placeholderDuration:
+		default:
+			return fmt.Errorf("reseller template %s: unknown placeholder %q", t.Name, param.Value)
+		}
+
+		if param.Case != "" && param.Case != caseUpper && param.Case != caseLower {
+			return fmt.Errorf("reseller template %s: unknown case %q", t.Name, param.Case)
+		}
+
+		if param.Unit != "" && param.Unit != unitSeconds && param.Unit != unitMinutes {
+			return fmt.Errorf("reseller template %s: unknown unit %q", t.Name, param.Unit)
+		}
+	}
+
+	return nil
+}
+
+// Templates - reseller templates by name, built in ones overridden by the ones of a file and of redis
+type Templates struct {
+	base      map[string]*Template
+	templates atomic.Pointer[map[string]*Template]
+
+	logger *zap.Logger
+}
+
+func NewTemplates(logger *zap.Logger) *Templates {
+	t := &Templates{base: make(map[string]*Template), logger: logger}
+	for _, template := range DefaultTemplates() {
+		t.base[template.Name] = template
+	}
+
+	templates := t.base
+	t.templates.Store(&templates)
+	return t
+}
+
+// Get - template of the reseller, nil when unknown
+func (t *Templates) Get(name string) *Template {
+	return (*t.templates.Load())[name]
+}
+
+// LoadFile - add the templates of a JSON array file to the built in ones, at startup before LoadRedis
+func (t *Templates) LoadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var templates []*Template
+	if err = json.Unmarshal(data, &templates); err != nil {
+		return fmt.Errorf("failed to parse reseller templates %s: %w", path, err)
+	}
+
+	for _, template := range templates {
+		if err = template.Validate(); err != nil {
+			return err
+		}
+		t.base[template.Name] = template
+	}
+
+	base := t.base
+	t.templates.Store(&base)
+	return nil
+}
+
+// LoadRedis - replace the templates of redis, a hash of reseller name to JSON template, on top of the base ones
+func (t *Templates) LoadRedis(ctx context.Context, client *redis.Client, key string) error {
+	values, err := client.HGetAll(ctx, key).Result()
+	if err != nil {
+		return err
+	}
+
+	templates := make(map[string]*Template, len(t.base)+len(values))
+	for name, template := range t.base {
+		templates[name] = template
+	}
+
+	for name, value := range values {
+		var template = new(Template)
+		if err = json.Unmarshal([]byte(value), template); err != nil {
+			t.logger.Error("invalid reseller template", zap.String("reseller", name), zap.Error(err))
+			continue
+		}
+
+		template.Name = name
+		if err = template.Validate(); err != nil {
+			t.logger.Error("invalid reseller template", zap.String("reseller", name), zap.Error(err))
+			continue
+		}
+
+		templates[name] = template
+	}
+
+	t.templates.Store(&templates)
+	return nil
+}
+
+// Listen - reload the templates of redis every period until ctx is done
+func (t *Templates) Listen(ctx context.Context, client *redis.Client, key string, period time.Duration) error {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			if err := t.LoadRedis(ctx, client, key); err != nil {
+				t.logger.Error("failed to load reseller templates", zap.Error(err))
+			}
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package provider
+
+import (
+	"testing"
+	"time"
+
+	"github.com/omimic12/proxy-server/pkg"
+	"go.uber.org/zap"
+)
+
+func TestTemplatesUsername(t *testing.T) {
+	tests := []struct {
+		name     string
+		reseller string
+		request  pkg.Request
+		want     string
+	}{
+		{
+			name:     "ttproxy without targeting",
+			reseller: pkg.ProviderTTProxy,
+			want:     "login",
+		},
+		{
+			name:     "ttproxy country",
+			reseller: pkg.ProviderTTProxy,
+			request:  pkg.Request{Country: []byte("us")},
+			want:     "login-cc-US",
+		},
+		{
+			name:     "ttproxy state and city",
+			reseller: pkg.ProviderTTProxy,
+			request:  pkg.Request{Country: []byte("us"), Region: []byte("CA"), City: []byte("LA")},
+			want:     "login-cc-US-state-ca-city-la",
+		},
+		{
+			name:     "ttproxy asn is not supported",
+			reseller: pkg.ProviderTTProxy,
+			request:  pkg.Request{Country: []byte("us"), ASN: 7922},
+			want:     "login-cc-US",
+		},
+		{
+			name:     "ttproxy sticky session",
+			reseller: pkg.ProviderTTProxy,
+			request:  pkg.Request{SessionID: "12"},
+			want:     "login-session-12",
+		},
+		{
+			name:     "ttproxy sticky session with duration",
+			reseller: pkg.ProviderTTProxy,
+			request:  pkg.Request{SessionID: "12", SessionDuration: 30 * time.Minute},
+			want:     "login-session-12-sessTime-30",
+		},
+		{
+			name:     "ttproxy duration below a minute",
+			reseller: pkg.ProviderTTProxy,
+			request:  pkg.Request{SessionID: "12", SessionDuration: 10 * time.Second},
+			want:     "login-session-12-sessTime-1",
+		},
+		{
+			name:     "ttproxy full targeting",
+			reseller: pkg.ProviderTTProxy,
+			request: pkg.Request{
+				Country: []byte("us"), Region: []byte("ca"), City: []byte("la"), Zip: []byte("9"), ASN: 7922,
+				SessionID: "12", SessionDuration: 30 * time.Minute,
+			},
+			want: "login-cc-US-state-ca-city-la-session-12-sessTime-30",
+		},
+		{
+			name:     "dataimpulse without targeting",
+			reseller: pkg.ProviderDataImpulse,
+			want:     "login",
+		},
+		{
+			name:     "dataimpulse country",
+			reseller: pkg.ProviderDataImpulse,
+			request:  pkg.Request{Country: []byte("US")},
+			want:     "login__cr.us",
+		},
+		{
+			name:     "dataimpulse state and city",
+			reseller: pkg.ProviderDataImpulse,
+			request:  pkg.Request{Country: []byte("us"), Region: []byte("CA"), City: []byte("LA")},
+			want:     "login__cr.us;state.ca;city.la",
+		},
+		{
+			name:     "dataimpulse asn",
+			reseller: pkg.ProviderDataImpulse,
+			request:  pkg.Request{ASN: 7922},
+			want:     "login__asn.7922",
+		},
+		{
+			name:     "dataimpulse sticky session",
+			reseller: pkg.ProviderDataImpulse,
+			request:  pkg.Request{SessionID: "12"},
+			want:     "login__sessid.12",
+		},
+		{
+			name:     "dataimpulse sticky session with duration",
+			reseller: pkg.ProviderDataImpulse,
+			request:  pkg.Request{SessionID: "12", SessionDuration: 30 * time.Minute},
+			want:     "login__sessid.12;sessttl.30",
+		},
+		{
+			name:     "dataimpulse duration below a minute",
+			reseller: pkg.ProviderDataImpulse,
+			request:  pkg.Request{SessionID: "12", SessionDuration: 10 * time.Second},
+			want:     "login__sessid.12;sessttl.1",
+		},
+		{
+			name:     "dataimpulse full targeting",
+			reseller: pkg.ProviderDataImpulse,
+			request: pkg.Request{
+				Country: []byte("us"), Region: []byte("ca"), City: []byte("la"), Zip: []byte("9"), ASN: 7922,
+				SessionID: "12", SessionDuration: 30 * time.Minute,
+			},
+			want: "login__cr.us;state.ca;city.la;zip.9;asn.7922;sessid.12;sessttl.30",
+		},
+	}
+
+	templates := NewTemplates(zap.NewNop())
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reseller, err := NewReseller(templates, tt.reseller, []byte("login"), []byte("pass"), 1, pkg.HTTP, nil, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, username, _, _, err := reseller.Credentials(&tt.request)
+			if err != nil {
+				t.Fatalf("Credentials() error = %v", err)
+			}
+
+			if string(username) != tt.want {
+				t.Errorf("username = %q, want %q", username, tt.want)
+			}
+		})
+	}
+}
@@ -38,6 +38,20 @@ func NewProxy(options ...Option) *Proxy {
 func (p *Proxy) selectProvider(purchase *Purchase, request *Request) error {
 	var err error
 
+	// the address of a UDP association is not a destination, its datagrams are checked as they are relayed
+	if !request.HasFeature(UDP) {
+		if p.config.Blocklist != nil && p.config.Blocklist.Blocked(purchase, request.Target) {
+			return ErrDomainBlocked
+		}
+
+		if p.config.Policy != nil {
+			err = p.config.Policy.Allow(purchase, request.Target, request.Port())
+			if err != nil {
+				return err
+			}
+		}
+	}
+
 	if request.SessionID != "" {
 		var ok bool
 		request.Provider, ok = p.config.Sessions.Cached(request)
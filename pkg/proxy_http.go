@@ -5,14 +5,18 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net"
 	"net/http"
 	"net/url"
+	"strconv"
+	"time"
 
 	"github.com/omimic12/proxy-server/constants"
 	"github.com/omimic12/proxy-server/pkg/measure"
 	"github.com/omimic12/proxy-server/pkg/zerocopy"
 	"github.com/pkg/errors"
+	"go.uber.org/zap"
 )
 
 const (
@@ -33,13 +37,6 @@ func (p *Proxy) ListenHTTP(ctx context.Context, port int) error {
 
 func (p *Proxy) handlerHTTP(w http.ResponseWriter, req *http.Request) {
 	var err error
-	username, password, err := extractCredentials(req, req)
-	if err != nil {
-		w.WriteHeader(http.StatusProxyAuthRequired)
-		w.Header().Add(constants.HeaderProxyAuthenticate, strHeaderBasicRealm)
-		return
-	}
-
 	request := acquireRequest()
 	request.Protocol = HTTP
 	request.Done = make(chan struct{}, 1)
@@ -58,6 +55,18 @@ func (p *Proxy) handlerHTTP(w http.ResponseWriter, req *http.Request) {
 	}
 	request.UserIP = userIP.String()
 
+	username, password, err := extractCredentials(req, req)
+	if err == ErrMissingAuth {
+		// Allowlisted clients may send no credentials at all
+		password, err = p.config.Auth.AuthenticateIP(req.Context(), userIP)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusProxyAuthRequired)
+		w.Header().Add(constants.HeaderProxyAuthenticate, strHeaderBasicRealm)
+		releaseRequest(request)
+		return
+	}
+
 	err = parseRequest(req.Host, username, password, request, p.config.Parser)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
@@ -91,7 +100,7 @@ func (p *Proxy) handlerHTTP(w http.ResponseWriter, req *http.Request) {
 	request.PurchaseType = PurchaseType(purchase.Type)
 
 	err = hasAccess(purchase, request)
-	if err == ErrDomainBlocked || err == ErrIPNotAllowed {
+	if err == ErrDomainBlocked || err == ErrIPNotAllowed || err == ErrIPNotPurchased {
 		p.config.Logger.Info(request.UserIP)
 		w.WriteHeader(http.StatusForbidden)
 		p.config.Measure.CountError(request.Password, measure.Errors403Forbidden)
@@ -111,6 +120,21 @@ func (p *Proxy) handlerHTTP(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	if p.outOfData(req.Context(), purchase, request) {
+		w.WriteHeader(http.StatusPaymentRequired)
+		p.config.Measure.CountError(request.Password, measure.Errors402PaymentRequired)
+		releaseRequest(request)
+		return
+	}
+
+	if limited, wait := p.rateLimited(req.Context(), purchase, request); limited {
+		w.Header().Set(constants.HeaderRetryAfter, strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		w.WriteHeader(http.StatusTooManyRequests)
+		p.config.Measure.CountError(request.Password, measure.Errors429TooManyRequests)
+		releaseRequest(request)
+		return
+	}
+
 	threads := p.config.ConnectionTracker.Watch(request.ID, request.PurchaseID, request.Done)
 	if purchase.Threads > 0 && threads >= purchase.Threads {
 		p.config.ConnectionTracker.Stop(request.ID, request.PurchaseID)
@@ -127,7 +151,20 @@ func (p *Proxy) handlerHTTP(w http.ResponseWriter, req *http.Request) {
 		releaseRequest(request) //nolint:errcheck
 		p.config.Measure.CountError(request.Password, measure.Errors403Forbidden)
 		return
-	} else if err == ErrFailedSelectProvider {
+	} else if err == ErrPortNotAllowed || err == ErrDestinationNotAllowed {
+		p.stopTracker(purchase, request)
+		w.WriteHeader(http.StatusForbidden)
+		p.logError(err, request)
+		p.config.Measure.CountError(request.Password, measure.Errors403PolicyDenied)
+		releaseRequest(request) //nolint:errcheck
+		return
+	} else if err == ErrLocationNotFound {
+		p.stopTracker(purchase, request)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		p.config.Measure.CountError(request.Password, measure.Errors503NoLocation)
+		releaseRequest(request) //nolint:errcheck
+		return
+	} else if err == ErrFailedSelectProvider || err == ErrIPNotFound {
 		p.stopTracker(purchase, request)
 		w.WriteHeader(http.StatusBadGateway)
 		p.logError(errors.Wrap(err, "failed to select provider"), request)
@@ -166,21 +203,30 @@ func (p *Proxy) serveHTTP(purchase *Purchase, request *Request, w http.ResponseW
 		releaseRequest(request)
 	}()
 
-	hostname, username, password, credentials, err := request.Provider.Credentials(request) // FIXME looks awkward
-	if err != nil {
-		w.WriteHeader(http.StatusGatewayTimeout)
-		p.config.Measure.CountError(request.Password, measure.Errors504GatewayTimeout)
-		return
+	writeMeter := p.newMeter(purchase, true, false, request.Password)
+	readMeter := p.newMeter(purchase, true, true, request.Password)
+	defer readMeter.flush() //nolint:errcheck
+
+	// Stream the body upstream, counting bytes as they go
+	var body *countingReader
+	var reqBody io.ReadCloser = http.NoBody
+	if req.Body != nil && req.Body != http.NoBody {
+		body = p.newCountingReader(req.Body, writeMeter, request.Done)
+		reqBody = body
+		defer func() {
+			request.Inc(body.flush())
+		}()
 	}
-	fmt.Printf("username = %s\tpassword = %s\n", string(username), string(password))
 
 	// Create a new request to the target URL through the real proxy
-	r, err := http.NewRequest(req.Method, req.URL.String(), req.Body)
+	r, err := http.NewRequest(req.Method, req.URL.String(), reqBody)
 	if err != nil {
 		w.WriteHeader(http.StatusGatewayTimeout)
 		p.config.Measure.CountError(request.Password, measure.Errors504GatewayTimeout)
 		return
 	}
+	r.ContentLength = req.ContentLength
+	r.TransferEncoding = req.TransferEncoding
 
 	// Copy headers from the original request
 	for key, values := range req.Header {
@@ -188,36 +234,37 @@ func (p *Proxy) serveHTTP(purchase *Purchase, request *Request, w http.ResponseW
 			r.Header.Add(key, value)
 		}
 	}
-	// Set the Authorization header
-	if len(credentials) > 0 {
-		r.Header.Set(constants.HeaderProxyAuthorization, "Basic "+zerocopy.String(credentials))
-	}
 
-	proxyStr := fmt.Sprintf("http://%s", hostname)
-
-	// Set up the real proxy
-	proxyURL, err := url.Parse(proxyStr)
-	if err != nil {
-		w.WriteHeader(http.StatusGatewayTimeout)
-		p.config.Measure.CountError(request.Password, measure.Errors504GatewayTimeout)
-		return
+	// The transport has not started streaming the body yet, no need to lock
+	size := headerSize(r)
+	request.Inc(size)
+	writeMeter.add(size) //nolint:errcheck
+	if body == nil {
+		defer writeMeter.flush() //nolint:errcheck
 	}
 
-	// Create a client with the proxy
-	client := &http.Client{
-		Transport: &http.Transport{
-			Proxy: http.ProxyURL(proxyURL),
-		},
-	}
-	request.Inc(headerSize(r))
-	p.config.Measure.IncWriteBytes(request.Password, headerSize(r))
+	// Send the request to the real proxy, failing over while it is safe to replay
+	replayable := p.config.Retry.replayable(r)
+	started := time.Now()
+
+	var resp *http.Response
+	for attempt := 1; ; attempt++ {
+		var client *http.Client
+		client, err = p.upstreamClient(request, r)
+		if err == nil {
+			resp, err = client.Do(r)
+			p.reportHealth(request.Provider, err)
+		}
 
-	// Send the request to the real proxy
-	resp, err := client.Do(r)
-	if err != nil {
-		w.WriteHeader(http.StatusGatewayTimeout)
-		p.config.Measure.CountError(request.Password, measure.Errors504GatewayTimeout)
-		return
+		if err == nil {
+			break
+		}
+
+		if !replayable || !p.failover(purchase, request, attempt, started, err) {
+			w.WriteHeader(http.StatusGatewayTimeout)
+			p.config.Measure.CountError(request.Password, measure.Errors504GatewayTimeout)
+			return
+		}
 	}
 	defer resp.Body.Close()
 
@@ -226,44 +273,75 @@ func (p *Proxy) serveHTTP(purchase *Purchase, request *Request, w http.ResponseW
 		for _, value := range values {
 			w.Header().Add(key, value)
 			request.Inc(int64(len(key) + len(value) + 2))
-			p.config.Measure.IncReadBytes(request.Password, int64(len(key)+len(value)+2))
+			readMeter.add(int64(len(key) + len(value) + 2)) //nolint:errcheck
 		}
 	}
 	w.WriteHeader(resp.StatusCode)
 
-	// Write the response body
-	respBodySize, err := io.Copy(w, resp.Body)
+	// Stream the response body, counting bytes as they go
+	_, err = io.Copy(p.newCountingWriter(w, request, readMeter), resp.Body)
 	if err != nil {
 		w.WriteHeader(http.StatusGatewayTimeout)
 		p.config.Measure.CountError(request.Password, measure.Errors504GatewayTimeout)
 		return
 	}
-	request.Inc(respBodySize + 2)
-	p.config.Measure.IncReadBytes(request.Password, respBodySize+2)
+	request.Inc(2)
+	readMeter.add(2) //nolint:errcheck
+}
+
+// upstreamClient - client forwarding r through the provider currently selected for the request
+func (p *Proxy) upstreamClient(request *Request, r *http.Request) (*http.Client, error) {
+	hostname, username, password, credentials, err := request.Provider.Credentials(request) // FIXME looks awkward
+	if err != nil {
+		return nil, err
+	}
+	p.config.Logger.Debug("upstream credentials", zap.ByteString("username", username))
 
-	if purchase.BandwidthLimited {
-		err = p.config.Accountant.Decrement(request.Password, request.Written)
-		if err != nil {
-			p.logError(err, request)
+	// Set up the real proxy
+	proxyURL := &url.URL{Scheme: string(HTTP), Host: hostname}
+	r.Header.Del(constants.HeaderProxyAuthorization)
+	if request.Provider.Protocol() == SOCKS5 {
+		// SOCKS5 upstreams authenticate during the handshake, not through headers
+		proxyURL.Scheme = string(SOCKS5)
+		if len(username) > 0 {
+			proxyURL.User = url.UserPassword(string(username), string(password))
 		}
+	} else if len(credentials) > 0 {
+		// Set the Authorization header
+		r.Header.Set(constants.HeaderProxyAuthorization, "Basic "+zerocopy.String(credentials))
 	}
+
+	// Create a client with the proxy
+	return &http.Client{
+		Transport: p.config.Transports.Transport(request.Provider, proxyURL, credentials),
+	}, nil
 }
 
 func (p *Proxy) serveHTTPS(purchase *Purchase, request *Request, w http.ResponseWriter, req *http.Request) {
-	_, username, password, _, err := request.Provider.Credentials(request) // FIXME looks awkward
+	_, username, _, _, err := request.Provider.Credentials(request) // FIXME looks awkward
 	if err != nil {
 		w.WriteHeader(http.StatusGatewayTimeout)
 		return
 	}
-	fmt.Printf("username = %s\tpassword = %s\n", string(username), string(password))
-	upstream, err := request.Provider.Dial([]byte(req.RequestURI), request)
-	if err != nil {
-		w.WriteHeader(http.StatusGatewayTimeout)
-		p.config.Measure.CountError(request.Password, measure.Errors504GatewayTimeout)
-		p.stopTracker(purchase, request)
-		p.logError(err, request)
-		releaseRequest(request)
-		return
+	p.config.Logger.Debug("upstream credentials", zap.ByteString("username", username))
+
+	var upstream net.Conn
+	started := time.Now()
+	for attempt := 1; ; attempt++ {
+		upstream, err = request.Provider.Dial([]byte(req.RequestURI), request)
+		p.reportHealth(request.Provider, err)
+		if err == nil {
+			break
+		}
+
+		if !p.failover(purchase, request, attempt, started, err) {
+			w.WriteHeader(http.StatusGatewayTimeout)
+			p.config.Measure.CountError(request.Password, measure.Errors504GatewayTimeout)
+			p.stopTracker(purchase, request)
+			p.logError(err, request)
+			releaseRequest(request)
+			return
+		}
 	}
 
 	request.Inc(headerSize(req))
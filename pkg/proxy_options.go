@@ -18,6 +18,14 @@ type Options struct {
 	Auth              Auth
 	Sessions          Sessions
 	Router            Router
+	Transports        Transports
+	Retry             RetryPolicy
+	Health            Health
+	Blocklist         Blocklist
+	Policy            Policy
+	RateLimiter       RateLimiter
+	Throttle          Throttle
+	Ledger            Ledger
 	ConnectionTracker ConnectionTracker
 	Accountant        Accountant
 	Measure           Measure
@@ -87,6 +95,54 @@ func WithRouter(router Router) Option {
 	}
 }
 
+func WithTransports(transports Transports) Option {
+	return func(options *Options) {
+		options.Transports = transports
+	}
+}
+
+func WithRetryPolicy(policy RetryPolicy) Option {
+	return func(options *Options) {
+		options.Retry = policy
+	}
+}
+
+func WithBlocklist(blocklist Blocklist) Option {
+	return func(options *Options) {
+		options.Blocklist = blocklist
+	}
+}
+
+func WithPolicy(policy Policy) Option {
+	return func(options *Options) {
+		options.Policy = policy
+	}
+}
+
+func WithRateLimiter(limiter RateLimiter) Option {
+	return func(options *Options) {
+		options.RateLimiter = limiter
+	}
+}
+
+func WithLedger(ledger Ledger) Option {
+	return func(options *Options) {
+		options.Ledger = ledger
+	}
+}
+
+func WithThrottle(throttle Throttle) Option {
+	return func(options *Options) {
+		options.Throttle = throttle
+	}
+}
+
+func WithHealth(health Health) Option {
+	return func(options *Options) {
+		options.Health = health
+	}
+}
+
 func WithTracker(tracker ConnectionTracker) Option {
 	return func(options *Options) {
 		options.ConnectionTracker = tracker
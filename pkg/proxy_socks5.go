@@ -0,0 +1,538 @@
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/omimic12/proxy-server/pkg/measure"
+	"github.com/omimic12/proxy-server/pkg/socks5"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	maxDatagramSize = 65535
+
+	// maxDatagramVerdicts - policy verdicts kept per association before they are dropped and checked again
+	maxDatagramVerdicts = 1024
+)
+
+func (p *Proxy) ListenSOCKS5(ctx context.Context, port int) error {
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		<-ctx.Done()
+		ln.Close() //nolint:errcheck
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+
+			return err
+		}
+
+		go p.handlerSOCKS5(conn)
+	}
+}
+
+func (p *Proxy) handlerSOCKS5(conn net.Conn) {
+	if p.config.ReadDeadline > 0 {
+		if err := conn.SetDeadline(time.Now().Add(p.config.ReadDeadline)); err != nil {
+			conn.Close() //nolint:errcheck
+			return
+		}
+	}
+
+	methods, err := socks5.ReadMethods(conn)
+	if err != nil {
+		conn.Close() //nolint:errcheck
+		return
+	}
+
+	request := acquireRequest()
+	request.Protocol = SOCKS5
+	request.Done = make(chan struct{}, 1)
+
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		conn.Close() //nolint:errcheck
+		releaseRequest(request)
+		return
+	}
+
+	userIP := net.ParseIP(host)
+	if userIP == nil {
+		conn.Close() //nolint:errcheck
+		releaseRequest(request)
+		return
+	}
+	request.UserIP = userIP.String()
+
+	// Credentials are preferred as they carry the targeting, allowlisted clients may send none
+	var username, password []byte
+	var method byte = socks5.MethodNoAcceptable
+	if hasMethod(methods, socks5.MethodUserPass) {
+		method = socks5.MethodUserPass
+	} else if hasMethod(methods, socks5.MethodNoAuth) {
+		allowlisted, err := p.config.Auth.AuthenticateIP(context.Background(), userIP)
+		if err == nil {
+			method = socks5.MethodNoAuth
+			password = []byte(allowlisted)
+		} else if err != ErrPurchaseNotFound {
+			p.logError(err, request)
+		}
+	}
+
+	_, err = conn.Write([]byte{socks5.Version, method})
+	if err != nil || method == socks5.MethodNoAcceptable {
+		conn.Close() //nolint:errcheck
+		releaseRequest(request)
+		return
+	}
+
+	if method == socks5.MethodUserPass {
+		username, password, err = socks5.ReadUserPass(conn)
+		if err != nil {
+			conn.Close() //nolint:errcheck
+			releaseRequest(request)
+			return
+		}
+	}
+	request.Password = string(password)
+
+	purchase, err := p.config.Auth.Authenticate(context.Background(), request.Password)
+	if err == ErrMissingAuth || err == ErrPurchaseNotFound {
+		p.config.Measure.CountError(request.Password, measure.Errors407AuthRequired)
+		p.rejectSOCKS5Auth(conn, request, method)
+		return
+	} else if err == ErrNotEnoughData {
+		p.config.Measure.CountError(request.Password, measure.Errors402PaymentRequired)
+		p.rejectSOCKS5Auth(conn, request, method)
+		return
+	} else if err != nil {
+		p.logError(err, request)
+		p.config.Measure.CountError(request.Password, measure.Errors500Internal)
+		p.rejectSOCKS5Auth(conn, request, method)
+		return
+	}
+
+	if method == socks5.MethodUserPass {
+		_, err = conn.Write([]byte{socks5.AuthVersion, socks5.AuthSuccess})
+		if err != nil {
+			conn.Close() //nolint:errcheck
+			releaseRequest(request)
+			return
+		}
+	}
+
+	cmd, addr, err := socks5.ReadRequest(conn)
+	if err == socks5.ErrInvalidAddrType {
+		p.replySOCKS5(conn, request, socks5.ReplyAddrNotSupported)
+		return
+	} else if err != nil {
+		conn.Close() //nolint:errcheck
+		releaseRequest(request)
+		return
+	}
+
+	if cmd != socks5.CmdConnect && cmd != socks5.CmdUDPAssociate {
+		p.replySOCKS5(conn, request, socks5.ReplyCommandNotSupported)
+		return
+	}
+
+	err = parseRequest(addr.String(), username, request.Password, request, p.config.Parser)
+	if err != nil {
+		p.config.Measure.CountError(request.Password, measure.Errors400BadRequest)
+		p.replySOCKS5(conn, request, socks5.ReplyGeneralFailure)
+		return
+	}
+
+	if cmd == socks5.CmdUDPAssociate {
+		request.Features = append(request.Features, UDP)
+	}
+
+	request.PurchaseID = purchase.ID
+	request.PurchaseType = PurchaseType(purchase.Type)
+
+	err = hasAccess(purchase, request)
+	if err == ErrDomainBlocked || err == ErrIPNotAllowed || err == ErrIPNotPurchased {
+		p.config.Measure.CountError(request.Password, measure.Errors403Forbidden)
+		p.replySOCKS5(conn, request, socks5.ReplyNotAllowed)
+		return
+	} else if err != nil {
+		p.logError(err, request)
+		p.config.Measure.CountError(request.Password, measure.Errors400BadRequest)
+		p.replySOCKS5(conn, request, socks5.ReplyGeneralFailure)
+		return
+	}
+
+	if p.outOfData(context.Background(), purchase, request) {
+		p.config.Measure.CountError(request.Password, measure.Errors402PaymentRequired)
+		p.replySOCKS5(conn, request, socks5.ReplyNotAllowed)
+		return
+	}
+
+	if limited, _ := p.rateLimited(context.Background(), purchase, request); limited {
+		p.config.Measure.CountError(request.Password, measure.Errors429TooManyRequests)
+		p.replySOCKS5(conn, request, socks5.ReplyNotAllowed)
+		return
+	}
+
+	threads := p.config.ConnectionTracker.Watch(request.ID, request.PurchaseID, request.Done)
+	if purchase.Threads > 0 && threads >= purchase.Threads {
+		p.config.ConnectionTracker.Stop(request.ID, request.PurchaseID)
+		p.config.Measure.CountError(request.Password, measure.Errors429TooManyRequests)
+		p.replySOCKS5(conn, request, socks5.ReplyNotAllowed)
+		return
+	}
+
+	err = p.selectProvider(purchase, request)
+	if err == ErrDomainBlocked {
+		p.stopTracker(purchase, request)
+		p.config.Measure.CountError(request.Password, measure.Errors403Forbidden)
+		p.replySOCKS5(conn, request, socks5.ReplyNotAllowed)
+		return
+	} else if err == ErrPortNotAllowed || err == ErrDestinationNotAllowed {
+		p.stopTracker(purchase, request)
+		p.logError(err, request)
+		p.config.Measure.CountError(request.Password, measure.Errors403PolicyDenied)
+		p.replySOCKS5(conn, request, socks5.ReplyNotAllowed)
+		return
+	} else if err == ErrLocationNotFound {
+		p.stopTracker(purchase, request)
+		p.config.Measure.CountError(request.Password, measure.Errors503NoLocation)
+		p.replySOCKS5(conn, request, socks5.ReplyNetworkUnreachable)
+		return
+	} else if err == ErrIPNotFound {
+		p.stopTracker(purchase, request)
+		p.logError(errors.Wrap(err, "failed to select provider"), request)
+		p.config.Measure.CountError(request.Password, measure.Errors502Internal)
+		p.replySOCKS5(conn, request, socks5.ReplyHostUnreachable)
+		return
+	} else if err != nil {
+		p.stopTracker(purchase, request)
+		p.logError(errors.Wrap(err, "failed to select provider"), request)
+		p.config.Measure.CountError(request.Password, measure.Errors502Internal)
+		p.replySOCKS5(conn, request, socks5.ReplyGeneralFailure)
+		return
+	}
+
+	p.config.Measure.IncRequest(request.Password)
+	p.config.Measure.LogThreads(request.Password, threads)
+
+	for _, feat := range adoptedFeatures(request) {
+		p.config.Measure.LogAdoptedFeature(request.Password, string(feat))
+	}
+
+	if cmd == socks5.CmdUDPAssociate {
+		p.serveSOCKS5UDP(purchase, request, addr, conn)
+		return
+	}
+
+	p.serveSOCKS5(purchase, request, addr, conn)
+}
+
+func (p *Proxy) serveSOCKS5(purchase *Purchase, request *Request, addr *socks5.Addr, conn net.Conn) {
+	var upstream net.Conn
+	var err error
+	started := time.Now()
+	for attempt := 1; ; attempt++ {
+		upstream, err = request.Provider.Dial([]byte(addr.String()), request)
+		p.reportHealth(request.Provider, err)
+		if err == nil {
+			break
+		}
+
+		if !p.failover(purchase, request, attempt, started, err) {
+			p.config.Measure.CountError(request.Password, measure.Errors504GatewayTimeout)
+			p.stopTracker(purchase, request)
+			p.logError(err, request)
+			p.replySOCKS5(conn, request, socks5.ReplyHostUnreachable)
+			return
+		}
+	}
+
+	bound, _ := socks5.ParseAddr(conn.LocalAddr().String()) //nolint:errcheck
+	err = socks5.WriteReply(conn, socks5.ReplySucceeded, bound)
+	if err == nil {
+		err = conn.SetDeadline(time.Time{})
+	}
+
+	if err != nil {
+		p.stopTracker(purchase, request)
+		_ = upstream.Close() //nolint:errcheck
+		_ = conn.Close()     //nolint:errcheck
+		releaseRequest(request)
+		return
+	}
+
+	_ = p.tunnel(purchase, request, upstream, conn)
+	releaseRequest(request)
+}
+
+func (p *Proxy) serveSOCKS5UDP(purchase *Purchase, request *Request, client *socks5.Addr, conn net.Conn) {
+	var upstream net.PacketConn
+	started := time.Now()
+	for attempt := 1; ; attempt++ {
+		provider, ok := request.Provider.(PacketProvider)
+		if !ok {
+			p.stopTracker(purchase, request)
+			p.logError(ErrUDPNotSupported, request)
+			p.config.Measure.CountError(request.Password, measure.Errors502Internal)
+			p.replySOCKS5(conn, request, socks5.ReplyCommandNotSupported)
+			return
+		}
+
+		var err error
+		upstream, err = provider.DialPacket(request)
+		p.reportHealth(request.Provider, err)
+		if err == nil {
+			break
+		}
+
+		if !p.failover(purchase, request, attempt, started, err) {
+			p.config.Measure.CountError(request.Password, measure.Errors504GatewayTimeout)
+			p.stopTracker(purchase, request)
+			p.logError(err, request)
+			p.replySOCKS5(conn, request, socks5.ReplyHostUnreachable)
+			return
+		}
+	}
+
+	var localIP net.IP
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		localIP = addr.IP
+	}
+
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: localIP})
+	if err != nil {
+		_ = upstream.Close() //nolint:errcheck
+		p.stopTracker(purchase, request)
+		p.logError(err, request)
+		p.config.Measure.CountError(request.Password, measure.Errors500Internal)
+		p.replySOCKS5(conn, request, socks5.ReplyGeneralFailure)
+		return
+	}
+
+	bound, _ := socks5.ParseAddr(relay.LocalAddr().String()) //nolint:errcheck
+	err = socks5.WriteReply(conn, socks5.ReplySucceeded, bound)
+	if err == nil {
+		err = conn.SetDeadline(time.Time{})
+	}
+
+	if err != nil {
+		p.stopTracker(purchase, request)
+		_ = upstream.Close() //nolint:errcheck
+		_ = relay.Close()    //nolint:errcheck
+		_ = conn.Close()     //nolint:errcheck
+		releaseRequest(request)
+		return
+	}
+
+	p.associate(purchase, request, client, conn, relay, upstream)
+	releaseRequest(request)
+}
+
+// associate - relay datagrams between the client and the upstream for as long as the control connection lives
+func (p *Proxy) associate(purchase *Purchase, request *Request, client *socks5.Addr, ctrl net.Conn, relay *net.UDPConn, upstream net.PacketConn) {
+	accountData := request.IP == nil
+	userIP := net.ParseIP(request.UserIP)
+
+	// Datagrams are only accepted from the client that authenticated the association
+	var peer atomic.Pointer[net.UDPAddr]
+	if ip := net.ParseIP(client.Host); ip != nil && ip.Equal(userIP) && client.Port != 0 {
+		peer.Store(&net.UDPAddr{IP: ip, Port: client.Port})
+	}
+
+	var (
+		once       sync.Once
+		terminated atomic.Bool
+		wg         sync.WaitGroup
+	)
+	closed := make(chan struct{})
+	shutdown := func() {
+		once.Do(func() {
+			close(closed)
+			ctrl.Close()     //nolint:errcheck
+			relay.Close()    //nolint:errcheck
+			upstream.Close() //nolint:errcheck
+		})
+	}
+
+	wg.Add(4)
+	go func() {
+		defer wg.Done()
+		select {
+		case <-request.Done:
+			terminated.Store(true)
+			shutdown()
+		case <-closed:
+		}
+	}()
+
+	go func() {
+		defer wg.Done()
+		defer shutdown()
+		io.Copy(io.Discard, ctrl) //nolint:errcheck
+	}()
+
+	go func() {
+		defer wg.Done()
+		defer shutdown()
+
+		m := p.newMeter(purchase, accountData, false, request.Password)
+		defer m.flush() //nolint:errcheck
+
+		verdicts := make(map[string]error)
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, src, err := relay.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+
+			if !src.IP.Equal(userIP) {
+				continue
+			}
+
+			if !peer.CompareAndSwap(nil, src) {
+				if known := peer.Load(); !known.IP.Equal(src.IP) || known.Port != src.Port {
+					continue
+				}
+			}
+
+			frag, dst, payload, err := socks5.ParseDatagram(buf[:n])
+			if err != nil || frag != 0 {
+				// fragmentation is optional and not supported
+				continue
+			}
+
+			if p.config.Blocklist != nil && p.config.Blocklist.Blocked(purchase, dst.Host) {
+				p.config.Measure.CountError(request.Password, measure.Errors403Forbidden)
+				continue
+			}
+
+			if err = p.allowDatagram(purchase, dst, verdicts); err != nil {
+				p.config.Measure.CountError(request.Password, measure.Errors403PolicyDenied)
+				continue
+			}
+
+			// request.Done belongs to the watcher above, shutdown closes the sockets instead
+			m.throttle(int64(len(payload)), nil)
+
+			if _, err = upstream.WriteTo(payload, dst); err != nil {
+				return
+			}
+			m.add(int64(len(payload))) //nolint:errcheck
+		}
+	}()
+
+	go func() {
+		defer wg.Done()
+		defer shutdown()
+
+		m := p.newMeter(purchase, accountData, true, request.Password)
+		defer m.flush() //nolint:errcheck
+
+		buf := make([]byte, maxDatagramSize)
+		out := make([]byte, 0, maxDatagramSize)
+		for {
+			n, src, err := upstream.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			dst := peer.Load()
+			if dst == nil {
+				continue
+			}
+
+			from, ok := src.(*socks5.Addr)
+			if !ok {
+				if from, err = socks5.ParseAddr(src.String()); err != nil {
+					continue
+				}
+			}
+
+			out, err = socks5.AppendDatagramHeader(out[:0], from)
+			if err != nil {
+				continue
+			}
+
+			m.throttle(int64(n), nil)
+
+			if _, err = relay.WriteToUDP(append(out, buf[:n]...), dst); err != nil {
+				return
+			}
+			m.add(int64(n)) //nolint:errcheck
+		}
+	}()
+
+	wg.Wait()
+
+	if terminated.Load() {
+		p.deleteTracker(purchase, request)
+	} else {
+		p.stopTracker(purchase, request)
+	}
+}
+
+// allowDatagram - policy verdict for the destination of a datagram, kept for the association to spare a lookup per datagram
+func (p *Proxy) allowDatagram(purchase *Purchase, dst *socks5.Addr, verdicts map[string]error) error {
+	if p.config.Policy == nil {
+		return nil
+	}
+
+	key := dst.String()
+	err, ok := verdicts[key]
+	if !ok {
+		if len(verdicts) >= maxDatagramVerdicts {
+			clear(verdicts)
+		}
+		err = p.config.Policy.Allow(purchase, dst.Host, dst.Port)
+		verdicts[key] = err
+	}
+	return err
+}
+
+func (p *Proxy) rejectSOCKS5Auth(conn net.Conn, request *Request, method byte) {
+	// Without the username/password sub-negotiation there is no auth reply, the connection is just dropped
+	if method == socks5.MethodUserPass {
+		conn.Write([]byte{socks5.AuthVersion, socks5.AuthFailure}) //nolint:errcheck
+	}
+	conn.Close() //nolint:errcheck
+	releaseRequest(request)
+}
+
+func (p *Proxy) replySOCKS5(conn net.Conn, request *Request, rep byte) {
+	if err := socks5.WriteReply(conn, rep, nil); err != nil {
+		p.config.Logger.Debug("failed to write socks5 reply", zap.Error(err))
+	}
+	conn.Close() //nolint:errcheck
+	releaseRequest(request)
+}
+
+func hasMethod(methods []byte, method byte) bool {
+	for _, m := range methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
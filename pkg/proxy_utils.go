@@ -8,12 +8,15 @@ import (
 	"net"
 	"time"
 
+	"github.com/omimic12/proxy-server/pkg/zerocopy"
 	"golang.org/x/sync/errgroup"
 )
 
 var (
 	ErrConnectionClosed   = errors.New("connection closed")
 	ErrIPNotFound         = errors.New("ip not found")
+	ErrLocationNotFound   = errors.New("no ip in targeted location")
+	ErrIPNotPurchased     = errors.New("ip not purchased")
 	ErrInvalidTargeting   = errors.New("invalid targeting")
 	ErrStickyNotSupported = errors.New("sticky not supported")
 )
@@ -31,8 +34,9 @@ var (
 
 func (p *Proxy) copy(purchase *Purchase, account bool, isRead bool, done <-chan struct{}, password string, src net.Conn, dst net.Conn) (err error) {
 	buf := make([]byte, p.config.BufferSize)
+	m := p.newMeter(purchase, account, isRead, password)
 
-	var accounted, written int64
+	var written int64
 LOOP:
 	for {
 		select {
@@ -49,20 +53,11 @@ LOOP:
 		}
 
 		nr, er := src.Read(buf)
-		accounted += int64(nr)
+		m.add(int64(nr)) //nolint:errcheck
 
-		if accounted >= p.config.AccountBytes {
-			if isRead {
-				err = p.config.Measure.IncReadBytes(password, accounted)
-			} else {
-				err = p.config.Measure.IncWriteBytes(password, accounted)
-			}
-
-			if purchase.BandwidthLimited && account {
-				err = p.config.Accountant.Decrement(password, accounted)
-			}
-
-			accounted = 0
+		if !m.throttle(int64(nr), done) {
+			err = ErrConnectionClosed
+			break LOOP
 		}
 
 		if nr > 0 {
@@ -87,17 +82,7 @@ LOOP:
 		}
 	}
 
-	if accounted >= 0 {
-		if isRead {
-			err = p.config.Measure.IncReadBytes(password, accounted)
-		} else {
-			err = p.config.Measure.IncWriteBytes(password, accounted)
-		}
-
-		if purchase.BandwidthLimited && account {
-			err = p.config.Accountant.Decrement(password, accounted)
-		}
-	}
+	m.flush() //nolint:errcheck
 
 	_ = dst.Close()
 	return
@@ -124,14 +109,28 @@ func (p *Proxy) tunnel(purchase *Purchase, request *Request, remote, conn net.Co
 }
 
 func hasAccess(purchase *Purchase, request *Request) error {
-	// if len(purchase.IPs) > 0 {
-	// 	_, ok := purchase.IPs[request.UserIP]
-	// 	if !ok {
-	// 		return ErrIPNotFound
-	// 	}
-	// }
-
-	if !purchase.CountryTargeting && request.Country != nil {
+	if !purchase.IsAllowed(net.ParseIP(request.UserIP)) {
+		return ErrIPNotAllowed
+	}
+
+	// Static and subnet purchases may only target the IPs they bought
+	if request.IP != nil {
+		if net.ParseIP(zerocopy.String(request.IP)) == nil {
+			return ErrInvalidTargeting
+		}
+
+		if PurchaseType(purchase.Type) == PurchaseStatic {
+			if _, ok := purchase.IPs[zerocopy.String(request.IP)]; !ok {
+				return ErrIPNotPurchased
+			}
+		}
+
+		if PurchaseType(purchase.Type) == PurchaseSubnet && !purchase.InSubnets(net.ParseIP(zerocopy.String(request.IP))) {
+			return ErrIPNotPurchased
+		}
+	}
+
+	if !purchase.CountryTargeting && request.HasLocation() {
 		return ErrInvalidTargeting
 	}
 
@@ -1,6 +1,8 @@
 package pkg
 
 import (
+	"net"
+	"strings"
 	"time"
 )
 
@@ -36,4 +38,65 @@ type Purchase struct {
 	CountryTargeting bool
 
 	BandwidthLimited bool
+
+	// AllowedIPs - client networks the purchase may be used from, any when empty
+	AllowedIPs []*net.IPNet
+
+	// Subnets - blocks whose IPs a subnet purchase rotates across
+	Subnets []*net.IPNet
+
+	// Pool - tag of the ISP proxies an isp_pool purchase selects from
+	Pool string
+
+	// RPS, Burst - token bucket of requests per second, unlimited when RPS is 0
+	RPS   float64
+	Burst int64
+
+	// UploadBPS, DownloadBPS - bytes per second shared by all connections, unlimited when 0
+	UploadBPS   int64
+	DownloadBPS int64
+}
+
+// IsAllowed - check the client ip may use the purchase
+func (p *Purchase) IsAllowed(ip net.IP) bool {
+	if len(p.AllowedIPs) == 0 {
+		return true
+	}
+
+	for _, network := range p.AllowedIPs {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// InSubnets - check the ip belongs to one of the purchased subnets
+func (p *Purchase) InSubnets(ip net.IP) bool {
+	for _, subnet := range p.Subnets {
+		if subnet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ParseNetwork - parse a CIDR, a plain IPv4 or IPv6 address is a single host network
+func ParseNetwork(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, &net.ParseError{Type: "IP address", Text: s}
+		}
+
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+
+	_, network, err := net.ParseCIDR(s)
+	return network, err
 }
@@ -0,0 +1,27 @@
+package pkg
+
+import (
+	"context"
+	"time"
+)
+
+// RateLimiter - requests per second limit of purchases
+type RateLimiter interface {
+	//Allow - take a request token of the purchase, when none is left report how long until the next one
+	Allow(ctx context.Context, purchase *Purchase) (bool, time.Duration, error)
+}
+
+// rateLimited - check the purchase is over its requests per second, the limit is not enforced while the limiter fails
+func (p *Proxy) rateLimited(ctx context.Context, purchase *Purchase, request *Request) (bool, time.Duration) {
+	if p.config.RateLimiter == nil {
+		return false, 0
+	}
+
+	ok, wait, err := p.config.RateLimiter.Allow(ctx, purchase)
+	if err != nil {
+		p.logError(err, request)
+		return false, 0
+	}
+
+	return !ok, wait
+}
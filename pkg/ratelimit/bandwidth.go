@@ -0,0 +1,55 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+
+	"github.com/bluele/gcache"
+	"github.com/omimic12/proxy-server/pkg"
+)
+
+// Bandwidth - upload and download caps per purchase, shared by all of its connections on this instance
+type Bandwidth struct {
+	mu      sync.Mutex
+	buckets gcache.Cache
+}
+
+// bandwidth - buckets of one purchase
+type bandwidth struct {
+	up, down Bucket
+}
+
+func NewBandwidth(size int) *Bandwidth {
+	return &Bandwidth{buckets: gcache.New(size).LRU().Build()}
+}
+
+func (b *Bandwidth) Reserve(purchase *pkg.Purchase, isRead bool, n int64) time.Duration {
+	rate := purchase.UploadBPS
+	if isRead {
+		rate = purchase.DownloadBPS
+	}
+
+	if rate <= 0 {
+		return 0
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var bw *bandwidth
+	value, err := b.buckets.Get(purchase.ID)
+	if err != nil {
+		bw = new(bandwidth)
+		b.buckets.Set(purchase.ID, bw) //nolint:errcheck
+	} else {
+		bw = value.(*bandwidth)
+	}
+
+	bucket := &bw.up
+	if isRead {
+		bucket = &bw.down
+	}
+
+	// one second worth of bytes may be moved at once
+	return bucket.Reserve(time.Now(), float64(rate), rate, n)
+}
@@ -0,0 +1,53 @@
+package ratelimit
+
+import (
+	"math"
+	"time"
+)
+
+// Bucket - token bucket refilled at rate tokens per second up to burst
+type Bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Take - take a token at now, when none is left report how long until the next one
+func (b *Bucket) Take(now time.Time, rate float64, burst int64) (bool, time.Duration) {
+	b.refill(now, rate, burst)
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	return false, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+}
+
+// burst - purchases without a burst may spend one second worth of requests at once
+func burst(rate float64, burst int64) int64 {
+	if burst > 0 {
+		return burst
+	}
+	return int64(math.Max(1, math.Ceil(rate)))
+}
+
+// Reserve - take n tokens at now going into debt, report how long until the debt is paid
+func (b *Bucket) Reserve(now time.Time, rate float64, burst int64, n int64) time.Duration {
+	b.refill(now, rate, burst)
+
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-b.tokens / rate * float64(time.Second))
+}
+
+func (b *Bucket) refill(now time.Time, rate float64, burst int64) {
+	if b.last.IsZero() {
+		b.tokens = float64(burst)
+	} else if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(float64(burst), b.tokens+elapsed*rate)
+	}
+	b.last = now
+}
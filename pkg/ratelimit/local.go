@@ -0,0 +1,46 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/bluele/gcache"
+	"github.com/omimic12/proxy-server/pkg"
+)
+
+// Local - buckets of this gateway instance only
+type Local struct {
+	mu      sync.Mutex
+	buckets gcache.Cache
+}
+
+func NewLocal(size int) *Local {
+	return &Local{buckets: gcache.New(size).LRU().Build()}
+}
+
+func (l *Local) Allow(_ context.Context, purchase *pkg.Purchase) (bool, time.Duration, error) {
+	if purchase.RPS <= 0 {
+		return true, 0, nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var bucket *Bucket
+	value, err := l.buckets.Get(purchase.ID)
+	if err == gcache.KeyNotFoundError {
+		bucket = new(Bucket)
+		err = l.buckets.Set(purchase.ID, bucket)
+		if err != nil {
+			return false, 0, err
+		}
+	} else if err != nil {
+		return false, 0, err
+	} else {
+		bucket = value.(*Bucket)
+	}
+
+	ok, wait := bucket.Take(time.Now(), purchase.RPS, burst(purchase.RPS, purchase.Burst))
+	return ok, wait, nil
+}
@@ -0,0 +1,72 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/omimic12/proxy-server/pkg"
+)
+
+// takeScript - token bucket kept in a hash of tokens and last refill time in milliseconds,
+// returns 1 and 0 when a token was taken, 0 and the milliseconds until the next token otherwise
+var takeScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+
+local bucket = redis.call("HMGET", KEYS[1], "tokens", "last")
+local tokens = tonumber(bucket[1])
+local last = tonumber(bucket[2])
+if tokens == nil then
+	tokens = burst
+elseif now > last then
+	tokens = math.min(burst, tokens + (now - last) / 1000 * rate)
+end
+
+local allowed = 0
+local wait = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+else
+	wait = math.ceil((1 - tokens) / rate * 1000)
+end
+
+redis.call("HSET", KEYS[1], "tokens", tostring(tokens), "last", tostring(math.max(now, last or now)))
+redis.call("PEXPIRE", KEYS[1], math.ceil(burst / rate * 1000) + 1000)
+return {allowed, wait}
+`)
+
+// Redis - buckets shared by every gateway instance
+type Redis struct {
+	client *redis.Client
+	prefix string
+}
+
+func NewRedis(client *redis.Client, prefix string) *Redis {
+	return &Redis{client: client, prefix: prefix}
+}
+
+func (r *Redis) Allow(ctx context.Context, purchase *pkg.Purchase) (bool, time.Duration, error) {
+	if purchase.RPS <= 0 {
+		return true, 0, nil
+	}
+
+	key := r.prefix + strconv.FormatUint(uint64(purchase.ID), 10)
+	result, err := takeScript.Run(ctx, r.client, []string{key},
+		purchase.RPS,
+		burst(purchase.RPS, purchase.Burst),
+		time.Now().UnixMilli(),
+	).Int64Slice()
+	if err != nil {
+		return false, 0, err
+	}
+
+	if result[0] == 1 {
+		return true, 0, nil
+	}
+	return false, time.Duration(math.Max(0, float64(result[1]))) * time.Millisecond, nil
+}
@@ -1,10 +1,17 @@
 package pkg
 
 import (
+	"bytes"
+	"net"
+	"strconv"
 	"sync/atomic"
 	"time"
 )
 
+const (
+	defaultHTTPPort = 80
+)
+
 type Request struct {
 	ID     string
 	UserIP string
@@ -14,8 +21,14 @@ type Request struct {
 	Protocol Protocol
 
 	//Targeting
-	IP      []byte
-	Country []byte
+	IP        []byte
+	Continent []byte
+	Country   []byte
+	Region    []byte
+	City      []byte
+	Zip       []byte
+	ASN       uint
+	ISP       []byte
 
 	ProfileName []byte
 	Category    []byte
@@ -31,6 +44,9 @@ type Request struct {
 	Provider     Provider
 	PurchaseType PurchaseType
 
+	//Excluded - providers which already failed to serve the request
+	Excluded []Provider
+
 	Password string
 
 	Written int64
@@ -48,11 +64,18 @@ func (r *Request) reset() {
 	r.Host = ""
 	r.Protocol = HTTP
 	r.Target = ""
+	r.Continent = nil
 	r.Country = nil
+	r.Region = nil
+	r.City = nil
+	r.Zip = nil
+	r.ASN = 0
+	r.ISP = nil
 	r.IP = nil
 	r.SessionID = ""
 	r.SessionDuration = 0
 	r.Provider = nil
+	r.Excluded = nil
 	r.PurchaseID = 0
 	r.PurchaseType = PurchaseStatic
 	r.Password = ""
@@ -67,6 +90,70 @@ func (r *Request) Inc(written int64) int64 {
 	return atomic.AddInt64(&r.Written, written)
 }
 
+func (r *Request) HasFeature(feature Feature) bool {
+	for _, f := range r.Features {
+		if bytes.Equal(f, feature) {
+			return true
+		}
+	}
+	return false
+}
+
+// HasLocation - check the request targets a location
+func (r *Request) HasLocation() bool {
+	return r.Continent != nil || r.Country != nil || r.Region != nil || r.City != nil || r.Zip != nil || r.ASN != 0 || r.ISP != nil
+}
+
+// InLocation - check the provider exits in the targeted location,
+// continents and zip codes are only known to providers routing them upstream
+func (r *Request) InLocation(provider Provider) bool {
+	if r.Continent != nil && !provider.HasRoutes(RouteContinent) {
+		return false
+	}
+	if r.Zip != nil && !provider.HasRoutes(RouteZip) {
+		return false
+	}
+	if r.Country != nil && !provider.HasCountry(string(r.Country)) {
+		return false
+	}
+	if r.Region != nil && !provider.HasRegion(string(r.Region)) {
+		return false
+	}
+	if r.City != nil && !provider.HasCity(string(r.City)) {
+		return false
+	}
+	if r.ASN != 0 && !provider.HasASN(r.ASN) {
+		return false
+	}
+	if r.ISP != nil && !provider.HasISP(string(r.ISP)) {
+		return false
+	}
+	return true
+}
+
+func (r *Request) IsExcluded(provider Provider) bool {
+	for _, p := range r.Excluded {
+		if p == provider {
+			return true
+		}
+	}
+	return false
+}
+
 func RequestKey(apiKey string, ID string) string {
 	return apiKey + ":" + ID
 }
+
+// Port - destination port, plain HTTP requests may omit it
+func (r *Request) Port() int {
+	_, port, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		return defaultHTTPPort
+	}
+
+	n, err := strconv.Atoi(port)
+	if err != nil {
+		return defaultHTTPPort
+	}
+	return n
+}
@@ -0,0 +1,86 @@
+package pkg
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// RetryPolicy - how upstream failures are retried on another provider
+type RetryPolicy struct {
+	//MaxAttempts - attempts per request including the first one
+	MaxAttempts int
+	//Budget - total time after which no further attempt is started
+	Budget time.Duration
+	//Methods - plain HTTP methods safe to replay upstream
+	Methods map[string]struct{}
+}
+
+func NewRetryPolicy(maxAttempts int, budget time.Duration, methods []string) RetryPolicy {
+	policy := RetryPolicy{
+		MaxAttempts: maxAttempts,
+		Budget:      budget,
+		Methods:     make(map[string]struct{}, len(methods)),
+	}
+
+	for _, method := range methods {
+		policy.Methods[strings.ToUpper(strings.TrimSpace(method))] = struct{}{}
+	}
+
+	return policy
+}
+
+// replayable - only idempotent requests without a body can be sent twice
+func (r RetryPolicy) replayable(req *http.Request) bool {
+	if req.Body != nil && req.Body != http.NoBody {
+		return false
+	}
+
+	_, ok := r.Methods[req.Method]
+	return ok
+}
+
+// failover - exclude the failed provider and route the request to another one
+func (p *Proxy) failover(purchase *Purchase, request *Request, attempt int, started time.Time, cause error) bool {
+	p.config.Logger.Warn("upstream attempt failed",
+		zap.Int("attempt", attempt),
+		zap.String("provider", request.Provider.Name()),
+		zap.String("target", request.Host),
+		zap.String("user_ip", request.UserIP),
+		zap.Error(cause))
+
+	policy := p.config.Retry
+	if attempt >= policy.MaxAttempts {
+		return false
+	}
+
+	if policy.Budget > 0 && time.Since(started) >= policy.Budget {
+		return false
+	}
+
+	request.Excluded = append(request.Excluded, request.Provider)
+
+	provider, err := p.config.Router.Route(purchase, request)
+	if err != nil {
+		p.logError(err, request)
+		return false
+	}
+	request.Provider = provider
+
+	// the session follows the provider that actually serves it
+	if request.SessionID != "" {
+		if err = p.config.Sessions.Start(request); err != nil {
+			p.logError(err, request)
+		}
+	}
+
+	p.config.Logger.Info("upstream attempt",
+		zap.Int("attempt", attempt+1),
+		zap.String("provider", provider.Name()),
+		zap.String("target", request.Host),
+		zap.String("user_ip", request.UserIP))
+
+	return true
+}
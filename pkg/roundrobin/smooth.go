@@ -0,0 +1,73 @@
+package roundrobin
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/omimic12/proxy-server/pkg"
+)
+
+var ErrNoProvider = errors.New("providers were not found")
+
+// Smooth - smooth weighted round robin, spreads picks of heavier nodes between the lighter ones
+type Smooth struct {
+	mu      sync.Mutex
+	nodes   []pkg.Provider
+	current map[pkg.Provider]int64
+}
+
+func NewSmooth(nodes []pkg.Provider) *Smooth {
+	return &Smooth{nodes: nodes, current: make(map[pkg.Provider]int64, len(nodes))}
+}
+
+// Rebuild - selection over nodes carrying on the state of the ones still present, s is left unchanged
+func (s *Smooth) Rebuild(nodes []pkg.Provider) *Smooth {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	next := NewSmooth(nodes)
+	for _, node := range nodes {
+		next.current[node] = s.current[node]
+	}
+	return next
+}
+
+// Next - pick the next node among the ones accepted by filter
+func (s *Smooth) Next(filter func(pkg.Provider) bool) (pkg.Provider, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var best pkg.Provider
+	var total int64
+	for _, node := range s.nodes {
+		if filter != nil && !filter(node) {
+			continue
+		}
+
+		weight := int64(node.Weight())
+		if weight <= 0 {
+			continue
+		}
+
+		s.current[node] += weight
+		total += weight
+
+		if best == nil || s.current[node] > s.current[best] {
+			best = node
+		}
+	}
+
+	if best == nil {
+		return nil, ErrNoProvider
+	}
+
+	s.current[best] -= total
+	return best, nil
+}
+
+func (s *Smooth) Size() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.nodes)
+}
@@ -0,0 +1,304 @@
+package router
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"sort"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/omimic12/proxy-server/pkg"
+	"github.com/omimic12/proxy-server/pkg/roundrobin"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	// scanCount - keys requested per SCAN page, every page is fetched with one MGET
+	scanCount = 1000
+)
+
+const (
+	proxyEventUpsert = "upsert"
+	proxyEventDelete = "delete"
+)
+
+// proxyEvent - change of a single proxy record published on the proxy channel
+type proxyEvent struct {
+	Op    string          `json:"op"`
+	Key   string          `json:"key"`
+	Proxy json.RawMessage `json:"proxy"`
+}
+
+// synchronize - full resync of the proxy records, the safety net behind proxy events
+func (r *WeightedRoundRobin) synchronize(ctx context.Context) {
+	// Events older than the scan are covered by it, the ones received during the scan are buffered.
+	// Before the first successful sync nothing covers the buffered events, they are replayed over the scan.
+	r.syncMu.Lock()
+	r.scanning = true
+	if r.synced {
+		r.pending = nil
+	}
+	r.syncMu.Unlock()
+
+	data, err := r.scan(ctx)
+
+	r.syncMu.Lock()
+	defer r.syncMu.Unlock()
+
+	r.scanning = false
+	if err != nil {
+		r.logger.Error("failed to sync proxies", zap.Error(err))
+
+		// without a first sync the buffered events are kept for the next one
+		if r.synced && len(r.pending) > 0 {
+			r.replay()
+		}
+		return
+	}
+
+	var records = make(map[string]*record, len(data))
+	for key, value := range data {
+		if rec := r.record(key, value); rec != nil {
+			records[key] = rec
+		}
+	}
+
+	r.events(records, r.pending)
+	r.pending = nil
+	r.synced = true
+
+	r.apply(records)
+}
+
+// scan - data of every proxy key
+func (r *WeightedRoundRobin) scan(ctx context.Context) (map[string][]byte, error) {
+	var data = make(map[string][]byte)
+	var cursor uint64
+	for {
+		keys, next, err := r.redisProxy.Scan(ctx, cursor, "*", scanCount).Result()
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to scan proxy keys")
+		}
+
+		if len(keys) > 0 {
+			values, err := r.redisProxy.MGet(ctx, keys...).Result()
+			if err != nil {
+				return nil, errors.Wrap(err, "failed to get proxies")
+			}
+
+			for i, value := range values {
+				// nil when the key was deleted after the scan
+				if str, ok := value.(string); ok {
+					data[keys[i]] = []byte(str)
+				}
+			}
+		}
+
+		cursor = next
+		if cursor == 0 {
+			return data, nil
+		}
+	}
+}
+
+// Listen - apply proxy events published on channel until ctx is done
+func (r *WeightedRoundRobin) Listen(ctx context.Context, channel string) error {
+	sub := r.redisProxy.Subscribe(ctx, channel)
+	defer sub.Close() //nolint:errcheck
+
+	ch := sub.Channel()
+	for {
+		select {
+		case m := <-ch:
+			messages := []*redis.Message{m}
+
+			// Coalesce bursts into a single pool rebuild
+			for drained := false; !drained; {
+				select {
+				case m := <-ch:
+					messages = append(messages, m)
+				default:
+					drained = true
+				}
+			}
+
+			r.update(messages)
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (r *WeightedRoundRobin) update(messages []*redis.Message) {
+	r.syncMu.Lock()
+	defer r.syncMu.Unlock()
+
+	// A scan in progress would overwrite the events, they are replayed once it is done
+	if r.scanning || !r.synced {
+		r.pending = append(r.pending, messages...)
+		return
+	}
+
+	r.pending = messages
+	r.replay()
+}
+
+// replay - apply the pending events on top of the current records, syncMu must be held
+func (r *WeightedRoundRobin) replay() {
+	var records = make(map[string]*record, len(r.records))
+	for key, rec := range r.records {
+		records[key] = rec
+	}
+
+	r.events(records, r.pending)
+	r.pending = nil
+
+	r.apply(records)
+}
+
+// events - apply proxy events to records, syncMu must be held
+func (r *WeightedRoundRobin) events(records map[string]*record, messages []*redis.Message) {
+	for _, m := range messages {
+		var event proxyEvent
+		err := json.Unmarshal([]byte(m.Payload), &event)
+		if err != nil {
+			r.logger.Error("failed to unmarshal proxy event", zap.Error(err))
+			continue
+		}
+
+		switch event.Op {
+		case proxyEventUpsert:
+			if rec := r.record(event.Key, event.Proxy); rec != nil {
+				records[event.Key] = rec
+			}
+		case proxyEventDelete:
+			delete(records, event.Key)
+		default:
+			r.logger.Error("unsupported proxy event " + event.Op)
+		}
+	}
+}
+
+// record - record of the proxy data, the current one is reused while the data is unchanged
+func (r *WeightedRoundRobin) record(key string, data []byte) *record {
+	if rec, ok := r.records[key]; ok && bytes.Equal(rec.data, data) {
+		return rec
+	}
+
+	var proxy = new(Proxy)
+	err := json.Unmarshal(data, proxy)
+	if err != nil {
+		r.logger.Error("failed to unmarshal proxy", zap.String("key", key), zap.Error(err))
+		return nil
+	}
+
+	p, err := proxyToProvider(r.dialTimeout, r.dialReadDeadline, r.templates, proxy)
+	if err != nil {
+		r.logger.Error("failed to convert proxy to provider", zap.String("key", key), zap.Error(err))
+		return nil
+	}
+
+	return &record{data: data, proxy: proxy, provider: p}
+}
+
+// apply - build the pool of records and swap it in, syncMu must be held
+func (r *WeightedRoundRobin) apply(records map[string]*record) {
+	// Keys are sorted to keep the selection order stable between rebuilds
+	var keys = make([]string, 0, len(records))
+	for key := range records {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var next = &pool{
+		providers:          make([]pkg.Provider, 0, len(records)),
+		ipStatic:           make(map[string]pkg.Provider),
+		ipStaticSlice:      make([]pkg.Provider, 0),
+		ipBackconnectSlice: make([]pkg.Provider, 0),
+		resellerSlice:      make([]pkg.Provider, 0),
+		ipSubnet:           make(map[string]pkg.Provider),
+		ipSubnetSlice:      make([]subnetIP, 0),
+		ipISP:              make(map[string]pkg.Provider),
+		ispSlices:          make(map[string][]pkg.Provider),
+	}
+	var purchases = make(map[uint]struct{})
+
+	for _, key := range keys {
+		rec := records[key]
+		next.providers = append(next.providers, rec.provider)
+
+		switch rec.proxy.Type {
+		case "static":
+			next.ipStaticSlice = append(next.ipStaticSlice, rec.provider)
+			next.ipStatic[rec.proxy.Host] = rec.provider
+		case "backconnect":
+			next.ipBackconnectSlice = append(next.ipBackconnectSlice, rec.provider)
+		case "subnet":
+			ip := net.ParseIP(rec.proxy.Host)
+			if ip == nil {
+				r.logger.Error("subnet proxy host is not an ip", zap.String("key", key))
+				continue
+			}
+			next.ipSubnetSlice = append(next.ipSubnetSlice, subnetIP{ip: ip, provider: rec.provider})
+			next.ipSubnet[rec.proxy.Host] = rec.provider
+		case "isp":
+			next.ispSlices[rec.proxy.Pool] = append(next.ispSlices[rec.proxy.Pool], rec.provider)
+			next.ipISP[rec.proxy.Host] = rec.provider
+		case "provider":
+			next.resellerSlice = append(next.resellerSlice, rec.provider)
+			purchases[rec.proxy.PurchaseID] = struct{}{}
+		default:
+			r.logger.Error("unsupported proxy type " + string(rec.proxy.Type))
+		}
+	}
+
+	var removed = make([]pkg.Provider, 0)
+	for key, rec := range r.records {
+		if records[key] != rec {
+			removed = append(removed, rec.provider)
+		}
+	}
+	r.records = records
+
+	// Selections carry on from the previous pool, the new one publishes them all at once
+	prev := r.pool.Load()
+	next.ipBackconnectPool = prev.ipBackconnectPool.Rebuild(next.ipBackconnectSlice)
+	next.ispPools = make(map[string]*roundrobin.Smooth, len(next.ispSlices))
+	for tag, slice := range next.ispSlices {
+		if ispPool, ok := prev.ispPools[tag]; ok {
+			next.ispPools[tag] = ispPool.Rebuild(slice)
+		} else {
+			next.ispPools[tag] = roundrobin.NewSmooth(slice)
+		}
+	}
+	r.pool.Store(next)
+
+	// Static and subnet pools are rebuilt from the new pool on the next request of their purchase
+	r.staticPools.Range(func(key, _ any) bool {
+		r.staticPools.Delete(key)
+		return true
+	})
+	r.subnetPools.Range(func(key, _ any) bool {
+		r.subnetPools.Delete(key)
+		return true
+	})
+
+	// Cursors of current purchases are maintained, the ones of gone purchases removed
+	r.resellerCursors.Range(func(key, _ any) bool {
+		if _, ok := purchases[key.(uint)]; !ok {
+			r.resellerCursors.Delete(key)
+		}
+		return true
+	})
+
+	r.removed(removed)
+
+	r.logger.Debug("proxies sync: done",
+		zap.Int("static", len(next.ipStaticSlice)),
+		zap.Int("backconnect", len(next.ipBackconnectSlice)),
+		zap.Int("subnet", len(next.ipSubnetSlice)),
+		zap.Int("isp_pools", len(next.ispSlices)),
+		zap.Int("reseller", len(next.resellerSlice)))
+}
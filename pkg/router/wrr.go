@@ -2,31 +2,101 @@ package router
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
-	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-redis/redis/v8"
 	"github.com/omimic12/proxy-server/pkg"
 	"github.com/omimic12/proxy-server/pkg/dialer"
 	"github.com/omimic12/proxy-server/pkg/provider"
+	"github.com/omimic12/proxy-server/pkg/roundrobin"
 	"github.com/omimic12/proxy-server/pkg/zerocopy"
 	"go.uber.org/zap"
 )
 
+// reserveAttempts - selections retried when the picked provider loses its half-open trial to a concurrent request
+const reserveAttempts = 3
+
 type WeightedRoundRobin struct {
-	fetchTimeout time.Duration
-	settings     pkg.Settings
+	dialTimeout      time.Duration
+	dialReadDeadline time.Duration
+	fetchTimeout     time.Duration
+	settings         pkg.Settings
+	redisProxy       *redis.Client
+
+	// pool - providers of the last sync, replaced as a whole and never modified
+	pool atomic.Pointer[pool]
+
+	// staticPools - weighted selection over the purchased static IPs, *purchasePool by purchase ID
+	staticPools sync.Map
+
+	// subnetPools - weighted selection over the IPs of the purchased subnets, *purchasePool by purchase ID
+	subnetPools sync.Map
+
+	// resellerCursors - round robin position per purchase, *atomic.Uint64 by purchase ID
+	resellerCursors sync.Map
+
+	// records - proxy records by redis key, providers are reused while their record is unchanged
+	// guarded by syncMu, shared by the full sync and the proxy events listener
+	syncMu  sync.Mutex
+	records map[string]*record
+
+	// pending - proxy events received while a full sync scans or before the first one is done,
+	// replayed on top of the scanned records, guarded by syncMu
+	pending  []*redis.Message
+	scanning bool
+	synced   bool
+
+	health pkg.Health
 
+	// templates - username templates of the resellers
+	templates *provider.Templates
+
+	mu       sync.Mutex
+	onRemove []func(pkg.Provider)
+
+	logger *zap.Logger
+}
+
+type pool struct {
+	providers          []pkg.Provider
 	ipStatic           map[string]pkg.Provider
 	ipStaticSlice      []pkg.Provider
 	ipBackconnectSlice []pkg.Provider
 	resellerSlice      []pkg.Provider
+	ipSubnet           map[string]pkg.Provider
+	ipSubnetSlice      []subnetIP
+	ipISP              map[string]pkg.Provider
+	ispSlices          map[string][]pkg.Provider
 
-	lastResellerIndexes map[uint]int
+	// ipBackconnectPool - weighted selection over the backconnect slice,
+	// rebuilt from the previous pool to keep the selection smooth across syncs
+	ipBackconnectPool *roundrobin.Smooth
+	// ispPools - weighted selection over the ISP proxies of a pool by pool tag, rebuilt like ipBackconnectPool
+	ispPools map[string]*roundrobin.Smooth
+}
 
-	logger *zap.Logger
+// purchasePool - weighted selection built for one purchase from one pool,
+// it is rebuilt once either of them changes
+type purchasePool struct {
+	pool     *pool
+	purchase *pkg.Purchase
+	smooth   *roundrobin.Smooth
+}
+
+// subnetIP - provider of one IP of a subnet block
+type subnetIP struct {
+	ip       net.IP
+	provider pkg.Provider
+}
+
+type record struct {
+	data     []byte
+	proxy    *Proxy
+	provider pkg.Provider
 }
 
 type Proxy struct {
@@ -36,10 +106,20 @@ type Proxy struct {
 	Password string `json:"password"`
 	Host     string `json:"host"`
 	Port     int    `json:"port"`
+	Weight   uint64 `json:"weight"`
 
 	PurchaseID uint   `json:"purchase_id"`
 	Region     string `json:"region"`
 	Reseller   string `json:"reseller"`
+
+	// Pool - tag of the ISP pool an isp proxy belongs to
+	Pool string `json:"pool"`
+
+	// Location of the exit IP, region is also the backconnect purchase region
+	Country string `json:"country"`
+	City    string `json:"city"`
+	ASN     uint   `json:"asn"`
+	ISP     string `json:"isp"`
 }
 
 func NewWeightedRoundRobin(
@@ -49,244 +129,345 @@ func NewWeightedRoundRobin(
 	fetchTimeout time.Duration,
 	proxySyncPeriod time.Duration,
 	redisProxy *redis.Client,
+	health pkg.Health,
+	templates *provider.Templates,
 	logger *zap.Logger,
 ) (*WeightedRoundRobin, error) {
 	w := &WeightedRoundRobin{
-		settings:     settings,
-		logger:       logger,
-		fetchTimeout: fetchTimeout,
+		dialTimeout:      dialTimeout,
+		dialReadDeadline: dialReadDeadline,
+		redisProxy:       redisProxy,
+		settings:         settings,
+		health:           health,
+		templates:        templates,
+		logger:           logger,
+		fetchTimeout:     fetchTimeout,
 	}
+	w.pool.Store(&pool{
+		ipStatic:          make(map[string]pkg.Provider),
+		ipSubnet:          make(map[string]pkg.Provider),
+		ipISP:             make(map[string]pkg.Provider),
+		ispSlices:         make(map[string][]pkg.Provider),
+		ipBackconnectPool: roundrobin.NewSmooth(nil),
+		ispPools:          make(map[string]*roundrobin.Smooth),
+	})
 
 	go func() {
 		ticker := time.NewTicker(proxySyncPeriod)
 		defer ticker.Stop()
 
-		var synchronize = func() {
-			keys, err := redisProxy.Keys(context.Background(), "*").Result()
-			if err != nil {
-				logger.Error("failed to get proxy keys", zap.Error(err))
-				return
-			}
+		w.synchronize(context.Background())
 
-			var ipStatic = make(map[string]pkg.Provider)
-			var ipStaticSlice = make([]pkg.Provider, 0)
-			var ipBackconnectSlice = make([]pkg.Provider, 0)
-			var resellerSlice = make([]pkg.Provider, 0)
-			var lastResellerIndexes = make(map[uint]int)
-
-			for _, key := range keys {
-				data, err := redisProxy.Get(context.Background(), key).Bytes()
-				if err != nil {
-					logger.Error("failed to get proxy", zap.String("key", key), zap.Error(err))
-					continue
-				}
-
-				var proxy = new(Proxy)
-				err = json.Unmarshal(data, proxy)
-				if err != nil {
-					logger.Error("failed to unmarshal proxy", zap.Error(err))
-					continue
-				}
+		for {
+			<-ticker.C
+			w.synchronize(context.Background())
+		}
+	}()
 
-				p, err := proxyToProvider(dialTimeout, dialReadDeadline, proxy)
-				if err != nil {
-					logger.Error("failed to convert proxy to provider", zap.Error(err))
-					continue
-				}
+	return w, nil
+}
 
-				switch proxy.Type {
-				case "static":
-					ipStaticSlice = append(ipStaticSlice, p)
-					ipStatic[proxy.Host] = p
-				case "backconnect":
-					ipBackconnectSlice = append(ipBackconnectSlice, p)
-				case "provider":
-					resellerSlice = append(resellerSlice, p)
-					lastResellerIndexes[proxy.PurchaseID] = -1
-				default:
-					logger.Error("unsupported proxy type " + string(proxy.Type))
-				}
-			}
+// OnRemove - register a callback invoked for providers dropped or replaced by the proxy sync
+func (r *WeightedRoundRobin) OnRemove(fn func(pkg.Provider)) {
+	r.mu.Lock()
+	r.onRemove = append(r.onRemove, fn)
+	r.mu.Unlock()
+}
 
-			w.ipStatic = ipStatic
-			w.ipStaticSlice = ipStaticSlice
-			w.ipBackconnectSlice = ipBackconnectSlice
-			w.resellerSlice = resellerSlice
-			// Adding indexes for new purchases only with maintaining current ones, removing unnecessary ones
-			if len(w.lastResellerIndexes) > 0 {
-				keysToRemove := make([]uint, 0)
-				keysToMaintain := make([]uint, 0)
-				for purchaseId := range w.lastResellerIndexes {
-					if _, exists := lastResellerIndexes[purchaseId]; !exists {
-						keysToRemove = append(keysToRemove, purchaseId)
-					} else {
-						keysToMaintain = append(keysToMaintain, purchaseId)
-					}
-				}
-				// Remove unnecessary
-				for _, key := range keysToRemove {
-					delete(w.lastResellerIndexes, key)
-				}
-				// Maintain current
-				for _, key := range keysToMaintain {
-					delete(lastResellerIndexes, key)
-				}
-				// Add new
-				if len(lastResellerIndexes) > 0 {
-					for purchaseId := range lastResellerIndexes {
-						w.lastResellerIndexes[purchaseId] = lastResellerIndexes[purchaseId]
-					}
-				}
-			} else {
-				w.lastResellerIndexes = lastResellerIndexes
-			}
+// Providers - every provider of the last proxy sync
+func (r *WeightedRoundRobin) Providers() []pkg.Provider {
+	return r.pool.Load().providers
+}
 
-			logger.Debug("proxies sync: done",
-				zap.Int("static", len(w.ipStaticSlice)),
-				zap.Int("backconnect", len(w.ipBackconnectSlice)),
-				zap.Int("reseller", len(w.resellerSlice)))
-		}
+func (r *WeightedRoundRobin) removed(providers []pkg.Provider) {
+	if len(providers) == 0 {
+		return
+	}
 
-		synchronize()
+	r.mu.Lock()
+	defer r.mu.Unlock()
 
-		for {
-			<-ticker.C
-			synchronize()
+	for _, p := range providers {
+		for _, fn := range r.onRemove {
+			fn(p)
 		}
-	}()
-
-	return w, nil
+	}
 }
 
 func (r *WeightedRoundRobin) Route(purchase *pkg.Purchase, request *pkg.Request) (pkg.Provider, error) {
 	return r.selectIP(purchase, request)
 }
 
-func (r *WeightedRoundRobin) selectIP(purchase *pkg.Purchase, _ *pkg.Request) (pkg.Provider, error) {
+// selectIP - pick a provider and reserve it with the health tracker
+func (r *WeightedRoundRobin) selectIP(purchase *pkg.Purchase, request *pkg.Request) (pkg.Provider, error) {
+	for attempt := 0; attempt < reserveAttempts; attempt++ {
+		p, err := r.pick(purchase, request)
+		if err != nil || r.health == nil || r.health.Reserve(p) {
+			return p, err
+		}
+		// a concurrent request took the half-open trial, the provider is no longer eligible
+	}
+	return nil, notFound(request)
+}
+
+func (r *WeightedRoundRobin) pick(purchase *pkg.Purchase, request *pkg.Request) (pkg.Provider, error) {
 	if purchase.Type == "static" {
-		i := 0
-		if len(r.ipStaticSlice) > 0 {
-			source := rand.NewSource(time.Now().UnixNano())
-			rs := rand.New(source)
-			max := len(r.ipStaticSlice)
-			i = rs.Intn(max-0) + 0
-		} else if len(r.ipStaticSlice) == 0 {
-			return nil, pkg.ErrIPNotFound
+		// Only the IPs bought with the purchase are eligible
+		pool := r.pool.Load()
+		staticPool := r.purchasePool(&r.staticPools, pool, purchase, sameIPs, func() []pkg.Provider {
+			purchased := make([]pkg.Provider, 0, len(purchase.IPs))
+			for ip := range purchase.IPs {
+				if static, ok := pool.ipStatic[ip]; ok {
+					purchased = append(purchased, static)
+				}
+			}
+			return purchased
+		})
+
+		var targeted pkg.Provider
+		if request.IP != nil {
+			targeted = pool.ipStatic[string(request.IP)]
 		}
-		return r.ipStaticSlice[i], nil
+
+		static, err := staticPool.Next(func(p pkg.Provider) bool {
+			return (request.IP == nil || p == targeted) && r.eligible(p, request)
+		})
+		if err != nil {
+			return nil, notFound(request)
+		}
+		return static, nil
 	}
 	if purchase.Type == "backconnect" {
-		// Extract from slice by region
-		ipBackconnectSliceByRegion := make([]pkg.Provider, 0)
-		for _, backconnect := range r.ipBackconnectSlice {
-			if backconnect.HasRegion(purchase.Region) {
-				ipBackconnectSliceByRegion = append(ipBackconnectSliceByRegion, backconnect)
+		// Select among the backconnects of the purchase region
+		backconnect, err := r.pool.Load().ipBackconnectPool.Next(func(p pkg.Provider) bool {
+			return p.HasRegion(purchase.Region) && r.eligible(p, request)
+		})
+		if err != nil {
+			return nil, notFound(request)
+		}
+		return backconnect, nil
+	}
+	if purchase.Type == "subnet" {
+		// Rotate across the IPs inside the purchased subnets
+		pool := r.pool.Load()
+		subnetPool := r.purchasePool(&r.subnetPools, pool, purchase, sameSubnets, func() []pkg.Provider {
+			var purchased []pkg.Provider
+			for _, subnet := range pool.ipSubnetSlice {
+				if purchase.InSubnets(subnet.ip) {
+					purchased = append(purchased, subnet.provider)
+				}
 			}
+			return purchased
+		})
+
+		var targeted pkg.Provider
+		if request.IP != nil {
+			targeted = pool.ipSubnet[string(request.IP)]
 		}
 
-		i := 0
-		if len(ipBackconnectSliceByRegion) > 0 {
-			source := rand.NewSource(time.Now().UnixNano())
-			rs := rand.New(source)
-			max := len(ipBackconnectSliceByRegion)
-			i = rs.Intn(max-0) + 0
-		} else if len(ipBackconnectSliceByRegion) == 0 {
+		subnet, err := subnetPool.Next(func(p pkg.Provider) bool {
+			return (request.IP == nil || p == targeted) && r.eligible(p, request)
+		})
+		if err != nil {
+			return nil, notFound(request)
+		}
+		return subnet, nil
+	}
+	if purchase.Type == "isp_pool" {
+		// Select among the ISP proxies tagged with the purchase pool
+		pool := r.pool.Load()
+		ispPool, ok := pool.ispPools[purchase.Pool]
+		if !ok {
 			return nil, pkg.ErrIPNotFound
 		}
-		return ipBackconnectSliceByRegion[i], nil
+
+		var targeted pkg.Provider
+		if request.IP != nil {
+			targeted = pool.ipISP[string(request.IP)]
+		}
+
+		isp, err := ispPool.Next(func(p pkg.Provider) bool {
+			return (request.IP == nil || p == targeted) && r.eligible(p, request)
+		})
+		if err != nil {
+			return nil, notFound(request)
+		}
+		return isp, nil
 	}
 	if purchase.Type == "provider" {
 		var resellerPurchased = make([]pkg.Provider, 0)
-		for _, reseller := range r.resellerSlice {
-			if reseller.PurchasedBy() == purchase.ID {
+		for _, reseller := range r.pool.Load().resellerSlice {
+			if reseller.PurchasedBy() == purchase.ID && r.eligible(reseller, request) {
 				resellerPurchased = append(resellerPurchased, reseller)
 			}
 		}
 
-		i := 0
-		if len(resellerPurchased) > 0 {
-			lastIndex := r.lastResellerIndexes[purchase.ID]
-			if lastIndex >= len(resellerPurchased)-1 {
-				i = 0
-			} else {
-				i = lastIndex + 1
-			}
-			r.lastResellerIndexes[purchase.ID] = i
-		} else if len(resellerPurchased) == 0 {
-			return nil, pkg.ErrIPNotFound
+		if len(resellerPurchased) == 0 {
+			return nil, notFound(request)
 		}
+
+		cursor, _ := r.resellerCursors.LoadOrStore(purchase.ID, new(atomic.Uint64))
+		i := (cursor.(*atomic.Uint64).Add(1) - 1) % uint64(len(resellerPurchased))
 		return resellerPurchased[i], nil
 	}
 	return nil, pkg.ErrPurchaseNotFound
 }
 
-func proxyToProvider(dialTimeout, readDeadline time.Duration, proxy *Proxy) (pkg.Provider, error) {
-	var p pkg.Provider
-	var d pkg.Dialer = dialer.NewHTTP(dialTimeout, readDeadline)
+// purchasePool - selection of the purchase cached in pools, built from pool when the cached one is outdated
+func (r *WeightedRoundRobin) purchasePool(
+	pools *sync.Map,
+	pool *pool,
+	purchase *pkg.Purchase,
+	same func(a, b *pkg.Purchase) bool,
+	build func() []pkg.Provider,
+) *roundrobin.Smooth {
+	if cached, ok := pools.Load(purchase.ID); ok && cached.(*purchasePool).pool == pool {
+		c := cached.(*purchasePool)
+		if c.purchase == purchase {
+			return c.smooth
+		}
+
+		// the purchase was reloaded, the selection is kept while what it bought is unchanged
+		if same(c.purchase, purchase) {
+			pools.Store(purchase.ID, &purchasePool{pool: pool, purchase: purchase, smooth: c.smooth})
+			return c.smooth
+		}
+	}
+
+	smooth := roundrobin.NewSmooth(build())
+	pools.Store(purchase.ID, &purchasePool{pool: pool, purchase: purchase, smooth: smooth})
+	return smooth
+}
+
+// sameIPs - check both purchases bought the same static IPs
+func sameIPs(a, b *pkg.Purchase) bool {
+	if len(a.IPs) != len(b.IPs) {
+		return false
+	}
+
+	for ip := range a.IPs {
+		if _, ok := b.IPs[ip]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// sameSubnets - check both purchases bought the same subnets
+func sameSubnets(a, b *pkg.Purchase) bool {
+	if len(a.Subnets) != len(b.Subnets) {
+		return false
+	}
+
+	for i := range a.Subnets {
+		if a.Subnets[i].String() != b.Subnets[i].String() {
+			return false
+		}
+	}
+	return true
+}
+
+// notFound - error of a selection without candidates, a targeted location is reported as such
+func notFound(request *pkg.Request) error {
+	if request.HasLocation() {
+		return pkg.ErrLocationNotFound
+	}
+	return pkg.ErrIPNotFound
+}
+
+// eligible - check the provider is able to carry the request
+func (r *WeightedRoundRobin) eligible(p pkg.Provider, request *pkg.Request) bool {
+	if request.IsExcluded(p) {
+		return false
+	}
+
+	if !request.InLocation(p) {
+		return false
+	}
+
+	if request.HasFeature(pkg.UDP) {
+		if _, ok := p.(pkg.PacketProvider); !ok || !p.HasFeatures(pkg.UDP) {
+			return false
+		}
+	}
+
+	if r.health != nil && !r.health.Available(p) {
+		return false
+	}
+
+	return true
+}
+
+func proxyToProvider(dialTimeout, readDeadline time.Duration, templates *provider.Templates, proxy *Proxy) (pkg.Provider, error) {
+	d, err := newDialer(dialTimeout, readDeadline, pkg.Protocol(proxy.Protocol))
+	if err != nil {
+		return nil, err
+	}
+
+	// records without a weight keep the equal share they always had
+	weight := proxy.Weight
+	if weight == 0 {
+		weight = 1
+	}
+
+	location := provider.Location{
+		Country: proxy.Country,
+		Region:  proxy.Region,
+		City:    proxy.City,
+		ASN:     proxy.ASN,
+		ISP:     proxy.ISP,
+	}
+
 	switch proxy.Type {
-	case "static":
+	case "static", "subnet", "isp":
 		return provider.NewStatic(
 			fmt.Sprintf("%s:%d", proxy.Host, proxy.Port),
 			zerocopy.Bytes(proxy.Username),
 			zerocopy.Bytes(proxy.Password),
-			1,
-			"static",
+			weight,
+			proxy.Type,
 			pkg.Protocol(proxy.Protocol),
 			d,
+			location,
 		)
 	case "backconnect":
 		return provider.NewBackconnect(
 			fmt.Sprintf("%s:%d", proxy.Host, proxy.Port),
 			zerocopy.Bytes(proxy.Username),
 			zerocopy.Bytes(proxy.Password),
-			1,
+			weight,
 			"backconnect",
 			pkg.Protocol(proxy.Protocol),
 			d,
-			proxy.Region,
+			location,
 		)
 	case "provider":
-		switch proxy.Reseller {
-		case "ttproxy":
-			p = provider.NewTTProxy(
-				zerocopy.Bytes(proxy.Username),
-				zerocopy.Bytes(proxy.Password),
-				1,
-				pkg.Protocol(proxy.Protocol),
-				d,
-				proxy.PurchaseID,
-			)
-		case "dataimpulse":
-			p = provider.NewDataImpulse(
-				zerocopy.Bytes(proxy.Username),
-				zerocopy.Bytes(proxy.Password),
-				1,
-				pkg.Protocol(proxy.Protocol),
-				d,
-				proxy.PurchaseID,
-			)
-		case "proxyverse":
-			p = provider.NewProxyverse(
-				zerocopy.Bytes(proxy.Password),
-				1,
-				pkg.Protocol(proxy.Protocol),
-				d,
-				proxy.PurchaseID,
-			)
-		case "databay":
-			p = provider.NewDatabay(
-				zerocopy.Bytes(proxy.Username),
-				zerocopy.Bytes(proxy.Password),
-				1,
-				pkg.Protocol(proxy.Protocol),
-				d,
-				proxy.PurchaseID,
-			)
-		default:
-			return nil, fmt.Errorf("wrong reseller %v", *proxy)
+		p, err := provider.NewReseller(
+			templates,
+			proxy.Reseller,
+			zerocopy.Bytes(proxy.Username),
+			zerocopy.Bytes(proxy.Password),
+			weight,
+			pkg.Protocol(proxy.Protocol),
+			d,
+			proxy.PurchaseID,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("wrong reseller %s: %w", proxy.Reseller, err)
 		}
 		return p, nil
 	default:
 		return nil, fmt.Errorf("wrong proxy type %s", proxy.Type)
 	}
 }
+
+func newDialer(dialTimeout, readDeadline time.Duration, protocol pkg.Protocol) (pkg.Dialer, error) {
+	switch protocol {
+	case pkg.HTTP, "":
+		return dialer.NewHTTP(dialTimeout, readDeadline), nil
+	case pkg.SOCKS5:
+		return dialer.NewSOCKS5(dialTimeout, readDeadline), nil
+	default:
+		return nil, fmt.Errorf("unsupported proxy protocol %s", protocol)
+	}
+}
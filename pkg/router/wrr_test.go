@@ -0,0 +1,353 @@
+package router
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/omimic12/proxy-server/pkg"
+	"github.com/omimic12/proxy-server/pkg/health"
+	"github.com/omimic12/proxy-server/pkg/provider"
+	"go.uber.org/zap"
+)
+
+// fakeRedis - serves SCAN and MGET over the proxy records, enough for synchronize
+type fakeRedis struct {
+	mu      sync.Mutex
+	records map[string]string
+
+	// failScan - SCAN replies with an error, scans - SCAN commands received
+	failScan bool
+	scans    int
+}
+
+func (f *fakeRedis) setFailScan(fail bool) {
+	f.mu.Lock()
+	f.failScan = fail
+	f.mu.Unlock()
+}
+
+func (f *fakeRedis) scanned() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.scans
+}
+
+func (f *fakeRedis) set(key, value string) {
+	f.mu.Lock()
+	f.records[key] = value
+	f.mu.Unlock()
+}
+
+func (f *fakeRedis) del(key string) {
+	f.mu.Lock()
+	delete(f.records, key)
+	f.mu.Unlock()
+}
+
+func (f *fakeRedis) serve(t *testing.T) *redis.Client {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.handle(conn)
+		}
+	}()
+
+	client := redis.NewClient(&redis.Options{Addr: ln.Addr().String()})
+	t.Cleanup(func() {
+		client.Close() //nolint:errcheck
+		ln.Close()     //nolint:errcheck
+	})
+	return client
+}
+
+func (f *fakeRedis) handle(conn net.Conn) {
+	defer conn.Close() //nolint:errcheck
+
+	r := bufio.NewReader(conn)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+
+		var reply strings.Builder
+		f.mu.Lock()
+		switch strings.ToUpper(args[0]) {
+		case "SCAN":
+			f.scans++
+			if f.failScan {
+				reply.WriteString("-ERR scan failed\r\n")
+				break
+			}
+
+			// a single page, cursor 0 ends the scan
+			fmt.Fprintf(&reply, "*2\r\n$1\r\n0\r\n*%d\r\n", len(f.records))
+			for key := range f.records {
+				fmt.Fprintf(&reply, "$%d\r\n%s\r\n", len(key), key)
+			}
+		case "MGET":
+			fmt.Fprintf(&reply, "*%d\r\n", len(args)-1)
+			for _, key := range args[1:] {
+				if value, ok := f.records[key]; ok {
+					fmt.Fprintf(&reply, "$%d\r\n%s\r\n", len(value), value)
+				} else {
+					reply.WriteString("$-1\r\n")
+				}
+			}
+		default:
+			reply.WriteString("+OK\r\n")
+		}
+		f.mu.Unlock()
+
+		if _, err = io.WriteString(conn, reply.String()); err != nil {
+			return
+		}
+	}
+}
+
+// readCommand - RESP array of bulk strings
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil || n <= 0 {
+		return nil, fmt.Errorf("invalid command %q", line)
+	}
+
+	args := make([]string, n)
+	for i := range args {
+		line, err = r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+
+		size, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+		if err != nil {
+			return nil, err
+		}
+
+		buf := make([]byte, size+2)
+		if _, err = io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+
+	return args, nil
+}
+
+func proxyRecord(t *testing.T, proxy Proxy) string {
+	t.Helper()
+
+	data, err := json.Marshal(proxy)
+	if err != nil {
+		t.Error(err)
+	}
+	return string(data)
+}
+
+func proxyEventMessage(t *testing.T, op, key string, proxy *Proxy) *redis.Message {
+	t.Helper()
+
+	event := proxyEvent{Op: op, Key: key}
+	if proxy != nil {
+		event.Proxy = json.RawMessage(proxyRecord(t, *proxy))
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		t.Error(err)
+	}
+	return &redis.Message{Payload: string(data)}
+}
+
+// TestRouteDuringSync - selection of every purchase type while full syncs and proxy events replace the pools, run with -race
+func TestRouteDuringSync(t *testing.T) {
+	base := map[string]Proxy{
+		"static:1":      {Type: "static", Host: "10.0.0.1", Port: 8080},
+		"static:2":      {Type: "static", Host: "10.0.0.2", Port: 8080},
+		"backconnect:1": {Type: "backconnect", Host: "bc.example.com", Port: 8080, Region: "us"},
+		"subnet:1":      {Type: "subnet", Host: "10.1.0.1", Port: 8080},
+		"subnet:2":      {Type: "subnet", Host: "10.1.0.2", Port: 8080},
+		"isp:1":         {Type: "isp", Host: "10.2.0.1", Port: 8080, Pool: "residential"},
+		"isp:2":         {Type: "isp", Host: "10.2.0.2", Port: 8080, Pool: "residential"},
+		"provider:1":    {Type: "provider", Reseller: pkg.ProviderTTProxy, Username: "login", Password: "pass", PurchaseID: 5},
+	}
+	// extra - records coming and going while requests are routed, the base ones always remain
+	extra := map[string]Proxy{
+		"static:3":      {Type: "static", Host: "10.0.0.3", Port: 8080},
+		"backconnect:2": {Type: "backconnect", Host: "bc2.example.com", Port: 8080, Region: "us", Weight: 3},
+		"subnet:3":      {Type: "subnet", Host: "10.1.0.3", Port: 8080},
+		"isp:3":         {Type: "isp", Host: "10.2.0.3", Port: 8080, Pool: "residential"},
+		"provider:2":    {Type: "provider", Reseller: pkg.ProviderDataImpulse, Username: "login", Password: "pass", PurchaseID: 5},
+	}
+
+	f := &fakeRedis{records: make(map[string]string)}
+	for key, proxy := range base {
+		f.set(key, proxyRecord(t, proxy))
+	}
+	client := f.serve(t)
+
+	logger := zap.NewNop()
+	r, err := NewWeightedRoundRobin(
+		nil,
+		time.Second,
+		time.Second,
+		time.Second,
+		time.Hour,
+		client,
+		health.NewBreaker(5, time.Minute, logger),
+		provider.NewTemplates(logger),
+		logger,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.synchronize(context.Background())
+
+	_, subnet, _ := net.ParseCIDR("10.1.0.0/30")
+	purchases := func() []*pkg.Purchase {
+		return []*pkg.Purchase{
+			{ID: 1, Type: "static", IPs: map[string]struct{}{"10.0.0.1": {}, "10.0.0.2": {}, "10.0.0.3": {}}},
+			{ID: 2, Type: "backconnect", Region: "us"},
+			{ID: 3, Type: "subnet", Subnets: []*net.IPNet{subnet}},
+			{ID: 4, Type: "isp_pool", Pool: "residential"},
+			{ID: 5, Type: "provider"},
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, purchase := range purchases() {
+		for i := 0; i < 2; i++ {
+			wg.Add(1)
+			go func(purchase *pkg.Purchase, reload bool) {
+				defer wg.Done()
+
+				for j := 0; j < 1000; j++ {
+					// a reloaded purchase is a new value with the same content
+					if reload {
+						for _, p := range purchases() {
+							if p.ID == purchase.ID {
+								purchase = p
+							}
+						}
+					}
+
+					p, err := r.Route(purchase, &pkg.Request{})
+					if err != nil {
+						t.Errorf("Route(%s) error = %v", purchase.Type, err)
+						return
+					}
+					if p == nil {
+						t.Errorf("Route(%s) returned no provider", purchase.Type)
+						return
+					}
+				}
+			}(purchase, i%2 == 1)
+		}
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		syncs(t, r, f, extra)
+	}()
+
+	wg.Wait()
+}
+
+// syncs - bring the extra records in and out through proxy events and full syncs
+func syncs(t *testing.T, r *WeightedRoundRobin, f *fakeRedis, extra map[string]Proxy) {
+	for i := 0; i < 50; i++ {
+		for key, proxy := range extra {
+			if i%2 == 0 {
+				r.update([]*redis.Message{proxyEventMessage(t, proxyEventUpsert, key, &proxy)})
+				f.set(key, proxyRecord(t, proxy))
+			} else {
+				r.update([]*redis.Message{proxyEventMessage(t, proxyEventDelete, key, nil)})
+				f.del(key)
+			}
+		}
+
+		if i%10 == 0 {
+			r.synchronize(context.Background())
+		}
+	}
+}
+
+// TestPendingAcrossFailedFirstSync - events received before any successful sync survive a failed one
+func TestPendingAcrossFailedFirstSync(t *testing.T) {
+	f := &fakeRedis{records: make(map[string]string), failScan: true}
+	f.set("static:1", proxyRecord(t, Proxy{Type: "static", Host: "10.0.0.1", Port: 8080}))
+	client := f.serve(t)
+
+	logger := zap.NewNop()
+	r, err := NewWeightedRoundRobin(
+		nil,
+		time.Second,
+		time.Second,
+		time.Second,
+		time.Hour,
+		client,
+		health.NewBreaker(5, time.Minute, logger),
+		provider.NewTemplates(logger),
+		logger,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// wait for the failed initial sync of the constructor, so it does not interleave with the ones below
+	for i := 0; i < 100; i++ {
+		r.syncMu.Lock()
+		done := f.scanned() > 0 && !r.scanning
+		r.syncMu.Unlock()
+		if done {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	event := Proxy{Type: "static", Host: "10.0.0.9", Port: 8080}
+	r.update([]*redis.Message{proxyEventMessage(t, proxyEventUpsert, "static:9", &event)})
+
+	r.synchronize(context.Background())
+
+	f.setFailScan(false)
+	r.synchronize(context.Background())
+
+	r.syncMu.Lock()
+	defer r.syncMu.Unlock()
+
+	if !r.synced {
+		t.Fatal("synced = false after a successful sync")
+	}
+	for _, key := range []string{"static:1", "static:9"} {
+		if _, ok := r.records[key]; !ok {
+			t.Errorf("records[%q] missing", key)
+		}
+	}
+}
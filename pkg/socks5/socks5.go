@@ -0,0 +1,236 @@
+package socks5
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+)
+
+// RFC 1928 / RFC 1929 wire constants
+const (
+	Version     = 0x05
+	AuthVersion = 0x01
+
+	MethodNoAuth       = 0x00
+	MethodUserPass     = 0x02
+	MethodNoAcceptable = 0xFF
+
+	CmdConnect      = 0x01
+	CmdBind         = 0x02
+	CmdUDPAssociate = 0x03
+
+	AddrIPv4   = 0x01
+	AddrDomain = 0x03
+	AddrIPv6   = 0x04
+
+	ReplySucceeded           = 0x00
+	ReplyGeneralFailure      = 0x01
+	ReplyNotAllowed          = 0x02
+	ReplyNetworkUnreachable  = 0x03
+	ReplyHostUnreachable     = 0x04
+	ReplyConnectionRefused   = 0x05
+	ReplyTTLExpired          = 0x06
+	ReplyCommandNotSupported = 0x07
+	ReplyAddrNotSupported    = 0x08
+
+	AuthSuccess = 0x00
+	AuthFailure = 0x01
+)
+
+var (
+	ErrInvalidVersion     = errors.New("invalid socks version")
+	ErrInvalidAuthVersion = errors.New("invalid socks auth version")
+	ErrInvalidAddrType    = errors.New("invalid socks address type")
+	ErrDomainTooLong      = errors.New("socks domain too long")
+	ErrShortDatagram      = errors.New("socks datagram too short")
+)
+
+// Addr - destination address as carried in SOCKS5 requests, replies and UDP headers
+type Addr struct {
+	Host string
+	Port int
+}
+
+func ParseAddr(hostport string) (*Addr, error) {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Addr{Host: host, Port: p}, nil
+}
+
+func (a *Addr) Network() string {
+	return "socks5"
+}
+
+func (a *Addr) String() string {
+	return net.JoinHostPort(a.Host, strconv.Itoa(a.Port))
+}
+
+// Append - append ATYP, DST.ADDR and DST.PORT to b
+func (a *Addr) Append(b []byte) ([]byte, error) {
+	ip := net.ParseIP(a.Host)
+	switch {
+	case ip == nil:
+		if len(a.Host) > 255 {
+			return nil, ErrDomainTooLong
+		}
+		b = append(b, AddrDomain, byte(len(a.Host)))
+		b = append(b, a.Host...)
+	case ip.To4() != nil:
+		b = append(b, AddrIPv4)
+		b = append(b, ip.To4()...)
+	default:
+		b = append(b, AddrIPv6)
+		b = append(b, ip.To16()...)
+	}
+
+	return binary.BigEndian.AppendUint16(b, uint16(a.Port)), nil
+}
+
+// ReadAddr - read ATYP, DST.ADDR and DST.PORT from r
+func ReadAddr(r io.Reader) (*Addr, error) {
+	var atyp [1]byte
+	if _, err := io.ReadFull(r, atyp[:]); err != nil {
+		return nil, err
+	}
+
+	var host string
+	switch atyp[0] {
+	case AddrIPv4:
+		var ip [net.IPv4len]byte
+		if _, err := io.ReadFull(r, ip[:]); err != nil {
+			return nil, err
+		}
+		host = net.IP(ip[:]).String()
+	case AddrIPv6:
+		var ip [net.IPv6len]byte
+		if _, err := io.ReadFull(r, ip[:]); err != nil {
+			return nil, err
+		}
+		host = net.IP(ip[:]).String()
+	case AddrDomain:
+		var l [1]byte
+		if _, err := io.ReadFull(r, l[:]); err != nil {
+			return nil, err
+		}
+		domain := make([]byte, l[0])
+		if _, err := io.ReadFull(r, domain); err != nil {
+			return nil, err
+		}
+		host = string(domain)
+	default:
+		return nil, ErrInvalidAddrType
+	}
+
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return nil, err
+	}
+
+	return &Addr{Host: host, Port: int(binary.BigEndian.Uint16(port[:]))}, nil
+}
+
+// ReadMethods - read the client greeting and return offered auth methods
+func ReadMethods(r io.Reader) ([]byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+
+	if header[0] != Version {
+		return nil, ErrInvalidVersion
+	}
+
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return nil, err
+	}
+
+	return methods, nil
+}
+
+// ReadUserPass - read RFC 1929 username/password sub-negotiation
+func ReadUserPass(r io.Reader) (username, password []byte, err error) {
+	var header [2]byte
+	if _, err = io.ReadFull(r, header[:]); err != nil {
+		return
+	}
+
+	if header[0] != AuthVersion {
+		return nil, nil, ErrInvalidAuthVersion
+	}
+
+	username = make([]byte, header[1])
+	if _, err = io.ReadFull(r, username); err != nil {
+		return
+	}
+
+	var l [1]byte
+	if _, err = io.ReadFull(r, l[:]); err != nil {
+		return
+	}
+
+	password = make([]byte, l[0])
+	_, err = io.ReadFull(r, password)
+	return
+}
+
+// ReadRequest - read VER, CMD, RSV and the destination address
+func ReadRequest(r io.Reader) (cmd byte, addr *Addr, err error) {
+	var header [3]byte
+	if _, err = io.ReadFull(r, header[:]); err != nil {
+		return
+	}
+
+	if header[0] != Version {
+		return 0, nil, ErrInvalidVersion
+	}
+
+	addr, err = ReadAddr(r)
+	return header[1], addr, err
+}
+
+// WriteReply - write VER, REP, RSV and the bound address
+func WriteReply(w io.Writer, rep byte, bound *Addr) error {
+	if bound == nil {
+		bound = &Addr{Host: net.IPv4zero.String()}
+	}
+
+	b, err := bound.Append([]byte{Version, rep, 0x00})
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(b)
+	return err
+}
+
+// AppendDatagramHeader - append RSV, FRAG and the address of a UDP request header to b
+func AppendDatagramHeader(b []byte, addr *Addr) ([]byte, error) {
+	return addr.Append(append(b, 0x00, 0x00, 0x00))
+}
+
+// ParseDatagram - split a UDP request into fragment number, address and payload
+func ParseDatagram(b []byte) (frag byte, addr *Addr, payload []byte, err error) {
+	if len(b) < 4 {
+		return 0, nil, nil, ErrShortDatagram
+	}
+
+	r := bytes.NewReader(b[3:])
+	addr, err = ReadAddr(r)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+
+	return b[2], addr, b[len(b)-r.Len():], nil
+}
@@ -0,0 +1,33 @@
+package pkg
+
+import (
+	"time"
+)
+
+// Throttle - bandwidth caps shared by every connection of a purchase
+type Throttle interface {
+	//Reserve - reserve n bytes moved in the direction, returning how long to wait before moving them
+	Reserve(purchase *Purchase, isRead bool, n int64) time.Duration
+}
+
+// throttle - wait until n bytes may be moved, false when done fired while waiting
+func (m *meter) throttle(n int64, done <-chan struct{}) bool {
+	if m.p.config.Throttle == nil || n <= 0 {
+		return true
+	}
+
+	wait := m.p.config.Throttle.Reserve(m.purchase, m.isRead, n)
+	if wait <= 0 {
+		return true
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-done:
+		return false
+	}
+}
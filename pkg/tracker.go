@@ -16,6 +16,9 @@ type ConnectionTracker interface {
 	//Delete - remove record but do not send a signal to the request channel
 	Delete(requestID string, purchaseID uint) (threads int64)
 
+	//Terminate - signal and remove every request of the password
+	Terminate(password string)
+
 	//Threads = return statistics of request execution by purchase uuid
 	Threads() map[uint]int64
 }
@@ -6,32 +6,47 @@ import (
 	"sync"
 
 	"github.com/go-redis/redis/v8"
-	"github.com/omimic12/proxy-server/pkg"
 	"go.uber.org/zap"
 )
 
 type Map struct {
 	mu        sync.RWMutex
-	requests  map[string]chan<- struct{}
+	requests  map[string]watched
+	passwords map[string]map[string]struct{}
 	purchases map[uint]int64
 	client    *redis.Client
 
 	logger *zap.Logger
 }
 
+type watched struct {
+	done       chan<- struct{}
+	purchaseID uint
+}
+
 func NewMap(client *redis.Client, logger *zap.Logger) *Map {
 	return &Map{
 		mu:        sync.RWMutex{},
 		client:    client,
 		logger:    logger,
 		purchases: make(map[uint]int64),
-		requests:  make(map[string]chan<- struct{}),
+		requests:  make(map[string]watched),
+		passwords: make(map[string]map[string]struct{}),
 	}
 }
 
 func (r *Map) Watch(requestID string, purchaseID uint, ch chan<- struct{}) int64 {
 	r.mu.Lock()
-	r.requests[requestID] = ch
+	r.requests[requestID] = watched{done: ch, purchaseID: purchaseID}
+
+	password := passwordOf(requestID)
+	ids, ok := r.passwords[password]
+	if !ok {
+		ids = make(map[string]struct{})
+		r.passwords[password] = ids
+	}
+	ids[requestID] = struct{}{}
+
 	threads, ok := r.purchases[purchaseID]
 	if !ok {
 		threads = 0
@@ -45,40 +60,48 @@ func (r *Map) Watch(requestID string, purchaseID uint, ch chan<- struct{}) int64
 }
 
 func (r *Map) Stop(requestID string, purchaseID uint) int64 {
-	r.mu.Lock()
-	d, ok := r.requests[requestID]
-	if !ok {
-		r.mu.Unlock()
-		return 0
-	}
-
-	d <- struct{}{}
-	delete(r.requests, requestID)
-
-	threads := r.purchases[purchaseID]
-	threads -= 1
-
-	if threads <= 0 {
-		delete(r.purchases, purchaseID)
-	} else {
-		r.purchases[purchaseID] = threads
-	}
-
-	r.mu.Unlock()
-
+	threads, _ := r.release(requestID, purchaseID, true)
 	return threads
 }
 
 func (r *Map) Delete(requestID string, purchaseID uint) int64 {
+	threads, _ := r.release(requestID, purchaseID, false)
+	return threads
+}
+
+// release - forget the request and optionally signal its channel, false when it was not tracked
+func (r *Map) release(requestID string, purchaseID uint, signal bool) (int64, bool) {
 	r.mu.Lock()
-	_, ok := r.requests[requestID]
+	defer r.mu.Unlock()
+
+	w, ok := r.requests[requestID]
 	if !ok {
-		r.mu.Unlock()
-		return 0
+		return 0, false
+	}
+
+	if signal {
+		w.done <- struct{}{}
 	}
+	r.forget(requestID)
 
+	return r.decrement(purchaseID), true
+}
+
+// forget - drop the request from the indexes, the caller holds the lock
+func (r *Map) forget(requestID string) {
 	delete(r.requests, requestID)
 
+	password := passwordOf(requestID)
+	if ids, ok := r.passwords[password]; ok {
+		delete(ids, requestID)
+		if len(ids) == 0 {
+			delete(r.passwords, password)
+		}
+	}
+}
+
+// decrement - count one thread less for the purchase, the caller holds the lock
+func (r *Map) decrement(purchaseID uint) int64 {
 	threads := r.purchases[purchaseID]
 	threads -= 1
 
@@ -88,8 +111,6 @@ func (r *Map) Delete(requestID string, purchaseID uint) int64 {
 		r.purchases[purchaseID] = threads
 	}
 
-	r.mu.Unlock()
-
 	return threads
 }
 
@@ -103,36 +124,87 @@ func (r *Map) Threads() map[uint]int64 {
 func (r *Map) Close() error {
 	r.mu.Lock()
 	for key, value := range r.requests {
-		value <- struct{}{}
+		value.done <- struct{}{}
 
 		delete(r.requests, key)
 	}
+	r.passwords = make(map[string]map[string]struct{})
 	r.mu.Unlock()
 
 	return nil
 }
 
+func (r *Map) Terminate(password string) {
+	r.terminate(password)
+}
+
+// terminate - signal and forget every request of the password, the released threads are returned by purchase
+func (r *Map) terminate(password string) map[uint]int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ids, ok := r.passwords[password]
+	if !ok {
+		return nil
+	}
+
+	released := make(map[uint]int64)
+	for requestID := range ids {
+		w := r.requests[requestID]
+		w.done <- struct{}{}
+
+		delete(r.requests, requestID)
+		r.decrement(w.purchaseID)
+		released[w.purchaseID]++
+	}
+	delete(r.passwords, password)
+
+	return released
+}
+
 func (r *Map) Listen(ctx context.Context, chUserInvalidate string) error {
+	return r.listen(ctx, chUserInvalidate, r.Terminate)
+}
+
+// listen - terminate the requests of every invalidated user
+func (r *Map) listen(ctx context.Context, chUserInvalidate string, terminate func(password string)) error {
 	userInvalidate := r.client.Subscribe(ctx, chUserInvalidate)
 	defer userInvalidate.Close() //nolint:errcheck
 
 	for {
 		select {
 		case m := <-userInvalidate.Channel():
-			requestKey := pkg.RequestKey(m.Payload, "")
-			r.mu.Lock()
-			for key, value := range r.requests {
-				if !strings.HasPrefix(key, requestKey) {
-					continue
-				}
-
-				value <- struct{}{}
-
-				delete(r.requests, key)
-			}
-			r.mu.Unlock()
+			terminate(m.Payload)
 		case <-ctx.Done():
 			return ctx.Err()
 		}
 	}
 }
+
+// threads - local threads of the purchase
+func (r *Map) threads(purchaseID uint) int64 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.purchases[purchaseID]
+}
+
+// snapshot - copy of the local threads by purchase
+func (r *Map) snapshot() map[uint]int64 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	threads := make(map[uint]int64, len(r.purchases))
+	for purchaseID, count := range r.purchases {
+		threads[purchaseID] = count
+	}
+	return threads
+}
+
+// passwordOf - password of a request ID built by pkg.RequestKey
+func passwordOf(requestID string) string {
+	if i := strings.LastIndexByte(requestID, ':'); i >= 0 {
+		return requestID[:i]
+	}
+	return requestID
+}
@@ -0,0 +1,215 @@
+package tracker
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"go.uber.org/zap"
+)
+
+// countScript - add the delta to the purchase threads of this node and renew its lease,
+// returns the threads of the purchase summed over the nodes whose lease is alive
+var countScript = redis.NewScript(`
+local threads = redis.call("HINCRBY", KEYS[1], ARGV[1], ARGV[2])
+if threads <= 0 then
+	redis.call("HDEL", KEYS[1], ARGV[1])
+end
+redis.call("PEXPIRE", KEYS[1], ARGV[3])
+redis.call("SADD", KEYS[2], KEYS[1])
+
+local total = 0
+for _, node in ipairs(redis.call("SMEMBERS", KEYS[2])) do
+	if redis.call("EXISTS", node) == 0 then
+		redis.call("SREM", KEYS[2], node)
+	else
+		total = total + tonumber(redis.call("HGET", node, ARGV[1]) or 0)
+	end
+end
+return total
+`)
+
+// threadsScript - threads of every purchase summed over the nodes whose lease is alive, as purchase and threads pairs
+var threadsScript = redis.NewScript(`
+local totals = {}
+for _, node in ipairs(redis.call("SMEMBERS", KEYS[1])) do
+	if redis.call("EXISTS", node) == 0 then
+		redis.call("SREM", KEYS[1], node)
+	else
+		local threads = redis.call("HGETALL", node)
+		for i = 1, #threads, 2 do
+			totals[threads[i]] = (totals[threads[i]] or 0) + tonumber(threads[i + 1])
+		end
+	end
+end
+
+local result = {}
+for purchase, threads in pairs(totals) do
+	if threads > 0 then
+		table.insert(result, purchase)
+		table.insert(result, threads)
+	end
+end
+return result
+`)
+
+// Redis - threads counted across every gateway instance.
+// Each node keeps its own counts in a hash leased for a while and renewed by Run,
+// the counts of a crashed node disappear with its lease.
+// Requests and their channels stay local, a node terminates only its own requests.
+type Redis struct {
+	local  *Map
+	client *redis.Client
+	node   string
+	nodes  string
+	lease  time.Duration
+
+	logger *zap.Logger
+}
+
+// NewRedis - node identifies the instance, hostname and pid when empty
+func NewRedis(client *redis.Client, prefix, node string, lease time.Duration, logger *zap.Logger) *Redis {
+	if node == "" {
+		hostname, _ := os.Hostname()
+		node = fmt.Sprintf("%s-%d", hostname, os.Getpid())
+	}
+
+	return &Redis{
+		local:  NewMap(client, logger),
+		client: client,
+		node:   prefix + "node:" + node,
+		nodes:  prefix + "nodes",
+		lease:  lease,
+		logger: logger,
+	}
+}
+
+func (r *Redis) Watch(requestID string, purchaseID uint, ch chan<- struct{}) int64 {
+	threads := r.local.Watch(requestID, purchaseID, ch)
+	return r.count(purchaseID, 1, threads)
+}
+
+func (r *Redis) Stop(requestID string, purchaseID uint) int64 {
+	threads, ok := r.local.release(requestID, purchaseID, true)
+	if !ok {
+		return 0
+	}
+	return r.count(purchaseID, -1, threads)
+}
+
+func (r *Redis) Delete(requestID string, purchaseID uint) int64 {
+	threads, ok := r.local.release(requestID, purchaseID, false)
+	if !ok {
+		return 0
+	}
+	return r.count(purchaseID, -1, threads)
+}
+
+// count - apply the delta cluster wide, the local threads are returned when redis is unavailable
+func (r *Redis) count(purchaseID uint, delta int64, local int64) int64 {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	threads, err := countScript.Run(ctx, r.client, []string{r.node, r.nodes},
+		strconv.FormatUint(uint64(purchaseID), 10),
+		delta,
+		r.lease.Milliseconds(),
+	).Int64()
+	if err != nil {
+		r.logger.Error("failed to count threads", zap.Uint("purchase", purchaseID), zap.Error(err))
+		return local
+	}
+
+	return threads
+}
+
+func (r *Redis) Threads() map[uint]int64 {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	result, err := threadsScript.Run(ctx, r.client, []string{r.nodes}).Slice()
+	if err != nil {
+		r.logger.Error("failed to load cluster threads", zap.Error(err))
+		return r.local.snapshot()
+	}
+
+	threads := make(map[uint]int64, len(result)/2)
+	for i := 0; i+1 < len(result); i += 2 {
+		purchase, ok := result[i].(string)
+		if !ok {
+			continue
+		}
+		purchaseID, err := strconv.ParseUint(purchase, 10, 64)
+		if err != nil {
+			continue
+		}
+		count, _ := result[i+1].(int64)
+		threads[uint(purchaseID)] = count
+	}
+
+	return threads
+}
+
+// Run - renew the lease of this node until ctx is done.
+// The hash is rewritten from the local counts so a failed update does not drift for long.
+func (r *Redis) Run(ctx context.Context) error {
+	ticker := time.NewTicker(r.lease / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			if err := r.heartbeat(ctx); err != nil {
+				r.logger.Error("failed to renew threads lease", zap.String("node", r.node), zap.Error(err))
+			}
+		}
+	}
+}
+
+func (r *Redis) heartbeat(ctx context.Context) error {
+	threads := r.local.snapshot()
+
+	_, err := r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, r.node)
+		if len(threads) > 0 {
+			values := make([]interface{}, 0, len(threads)*2)
+			for purchaseID, count := range threads {
+				values = append(values, strconv.FormatUint(uint64(purchaseID), 10), count)
+			}
+			pipe.HSet(ctx, r.node, values...)
+			pipe.PExpire(ctx, r.node, r.lease)
+			pipe.SAdd(ctx, r.nodes, r.node)
+		}
+		return nil
+	})
+	return err
+}
+
+// Terminate - only the requests served by this instance are terminated
+func (r *Redis) Terminate(password string) {
+	for purchaseID, released := range r.local.terminate(password) {
+		r.count(purchaseID, -released, r.local.threads(purchaseID))
+	}
+}
+
+func (r *Redis) Listen(ctx context.Context, chUserInvalidate string) error {
+	return r.local.listen(ctx, chUserInvalidate, r.Terminate)
+}
+
+// Close - terminate local requests and give up the lease
+func (r *Redis) Close() error {
+	err := r.local.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	r.client.Del(ctx, r.node)           //nolint:errcheck
+	r.client.SRem(ctx, r.nodes, r.node) //nolint:errcheck
+
+	return err
+}
@@ -0,0 +1,12 @@
+package pkg
+
+import (
+	"net/http"
+	"net/url"
+)
+
+// Transports - pool of transports reused to forward plain HTTP requests through upstream proxies
+type Transports interface {
+	//Transport - return a transport keyed by provider and upstream credentials
+	Transport(provider Provider, proxyURL *url.URL, credentials []byte) *http.Transport
+}
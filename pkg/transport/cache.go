@@ -0,0 +1,190 @@
+package transport
+
+import (
+	"container/list"
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/omimic12/proxy-server/pkg"
+	"go.uber.org/zap"
+)
+
+const (
+	keepAlive = 30 * time.Second
+)
+
+type Cache struct {
+	mu        sync.Mutex
+	size      int
+	lru       *list.List
+	entries   map[string]*list.Element
+	providers map[pkg.Provider]map[string]struct{}
+
+	dialTimeout         time.Duration
+	maxIdleConnsPerHost int
+	idleConnTimeout     time.Duration
+
+	hits      atomic.Int64
+	misses    atomic.Int64
+	evictions atomic.Int64
+
+	logger *zap.Logger
+}
+
+type entry struct {
+	key       string
+	provider  pkg.Provider
+	transport *http.Transport
+}
+
+type Stats struct {
+	Size      int
+	Hits      int64
+	Misses    int64
+	Evictions int64
+}
+
+func NewCache(
+	size int,
+	dialTimeout time.Duration,
+	maxIdleConnsPerHost int,
+	idleConnTimeout time.Duration,
+	logger *zap.Logger,
+) *Cache {
+	return &Cache{
+		size:                size,
+		lru:                 list.New(),
+		entries:             make(map[string]*list.Element),
+		providers:           make(map[pkg.Provider]map[string]struct{}),
+		dialTimeout:         dialTimeout,
+		maxIdleConnsPerHost: maxIdleConnsPerHost,
+		idleConnTimeout:     idleConnTimeout,
+		logger:              logger,
+	}
+}
+
+func (c *Cache) Transport(provider pkg.Provider, proxyURL *url.URL, credentials []byte) *http.Transport {
+	key := proxyURL.String() + "|" + string(credentials)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		e := el.Value.(*entry)
+		if e.provider == provider {
+			c.hits.Add(1)
+			c.lru.MoveToFront(el)
+			return e.transport
+		}
+
+		// the same upstream was re-created by the proxy sync
+		c.remove(el)
+	}
+
+	c.misses.Add(1)
+
+	e := &entry{
+		key:      key,
+		provider: provider,
+		transport: &http.Transport{
+			Proxy: http.ProxyURL(proxyURL),
+			DialContext: (&net.Dialer{
+				Timeout:   c.dialTimeout,
+				KeepAlive: keepAlive,
+			}).DialContext,
+			MaxIdleConnsPerHost: c.maxIdleConnsPerHost,
+			IdleConnTimeout:     c.idleConnTimeout,
+		},
+	}
+
+	c.entries[key] = c.lru.PushFront(e)
+	keys, ok := c.providers[provider]
+	if !ok {
+		keys = make(map[string]struct{})
+		c.providers[provider] = keys
+	}
+	keys[key] = struct{}{}
+
+	for c.size > 0 && c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+	}
+
+	return e.transport
+}
+
+// Evict - close and drop every transport of the provider
+func (c *Cache) Evict(provider pkg.Provider) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key := range c.providers[provider] {
+		if el, ok := c.entries[key]; ok {
+			c.remove(el)
+		}
+	}
+	delete(c.providers, provider)
+}
+
+func (c *Cache) Stats() Stats {
+	c.mu.Lock()
+	size := c.lru.Len()
+	c.mu.Unlock()
+
+	return Stats{
+		Size:      size,
+		Hits:      c.hits.Load(),
+		Misses:    c.misses.Load(),
+		Evictions: c.evictions.Load(),
+	}
+}
+
+// Report - periodically log cache statistics
+func (c *Cache) Report(ctx context.Context, period time.Duration) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			stats := c.Stats()
+			c.logger.Info("transport cache",
+				zap.Int("size", stats.Size),
+				zap.Int64("hits", stats.Hits),
+				zap.Int64("misses", stats.Misses),
+				zap.Int64("evictions", stats.Evictions))
+		}
+	}
+}
+
+func (c *Cache) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for c.lru.Len() > 0 {
+		c.remove(c.lru.Back())
+	}
+
+	return nil
+}
+
+func (c *Cache) remove(el *list.Element) {
+	e := c.lru.Remove(el).(*entry)
+	delete(c.entries, e.key)
+
+	if keys, ok := c.providers[e.provider]; ok {
+		delete(keys, e.key)
+		if len(keys) == 0 {
+			delete(c.providers, e.provider)
+		}
+	}
+
+	e.transport.CloseIdleConnections()
+	c.evictions.Add(1)
+}
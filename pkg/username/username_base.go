@@ -2,6 +2,7 @@ package username
 
 import (
 	"bytes"
+	"encoding/binary"
 	"errors"
 	"strconv"
 	"strings"
@@ -28,6 +29,16 @@ var (
 	byteUsernameRandom   = []byte("rr")
 )
 
+var (
+	byteUsernameContinent = []byte("continent")
+	byteUsernameState     = []byte("state")
+	byteUsernameRegion    = []byte("region")
+	byteUsernameCity      = []byte("city")
+	byteUsernameZip       = []byte("zip")
+	byteUsernameASN       = []byte("asn")
+	byteUsernameISP       = []byte("isp")
+)
+
 var (
 	hashPool = sync.Pool{}
 )
@@ -37,8 +48,21 @@ var (
 	ErrInvalidTargeting = errors.New("invalid targeting")
 	ErrInvalidCountry   = errors.New("invalid country")
 	ErrInvalidRegion    = errors.New("invalid region")
+	ErrInvalidContinent = errors.New("invalid continent")
+	ErrInvalidASN       = errors.New("invalid asn")
 )
 
+// continents - continent codes accepted in usernames by the continent name used by gountries
+var continents = map[string]string{
+	"af": "Africa",
+	"an": "Antarctica",
+	"as": "Asia",
+	"eu": "Europe",
+	"na": "North America",
+	"oc": "Oceania",
+	"sa": "South America",
+}
+
 // acquireHash returns a hash from pool
 func acquireHash() *xxhash.Digest {
 	v := hashPool.Get()
@@ -118,6 +142,29 @@ func (s *Base) Parse(username []byte, req *pkg.Request) (err error) {
 		} else if bytes.EqualFold(p, byteUsernameIP) {
 			req.IP = params[i]
 			continue
+		} else if bytes.EqualFold(p, byteUsernameContinent) {
+			req.Continent = bytes.ToLower(params[i])
+			continue
+		} else if bytes.EqualFold(p, byteUsernameState) || bytes.EqualFold(p, byteUsernameRegion) {
+			req.Region = params[i]
+			continue
+		} else if bytes.EqualFold(p, byteUsernameCity) {
+			req.City = params[i]
+			continue
+		} else if bytes.EqualFold(p, byteUsernameZip) {
+			req.Zip = params[i]
+			continue
+		} else if bytes.EqualFold(p, byteUsernameASN) {
+			asn, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(zerocopy.String(params[i])), "as"), 10, 32)
+			if err != nil || asn == 0 {
+				return ErrInvalidASN
+			}
+
+			req.ASN = uint(asn)
+			continue
+		} else if bytes.EqualFold(p, byteUsernameISP) {
+			req.ISP = params[i]
+			continue
 		}
 	}
 
@@ -136,6 +183,11 @@ func (s *Base) Parse(username []byte, req *pkg.Request) (err error) {
 		}
 	}
 
+	err = s.validateLocation(req)
+	if err != nil {
+		return err
+	}
+
 	if len(sessionID) > 0 {
 		if req.SessionDuration <= 0 || req.SessionDuration > s.sessionDurationMax {
 			req.SessionDuration = s.sessionDuration
@@ -144,21 +196,21 @@ func (s *Base) Parse(username []byte, req *pkg.Request) (err error) {
 		digest := acquireHash()
 		defer releaseHash(digest)
 
-		if req.Country != nil {
-			_, err = digest.Write(req.Country)
-			if err != nil {
-				return err
-			}
+		var asn []byte
+		if req.ASN != 0 {
+			asn = strconv.AppendUint(nil, uint64(req.ASN), 10)
 		}
 
-		_, err = digest.Write(sessionID)
-		if err != nil {
-			return err
+		// a session keeps its exit only for the same targeting
+		fields := [][]byte{
+			req.Country, req.Continent, req.Region, req.City, req.Zip, asn, req.ISP,
+			sessionID, zerocopy.Bytes(req.Password),
 		}
-
-		_, err = digest.WriteString(req.Password)
-		if err != nil {
-			return err
+		for _, field := range fields {
+			err = writeField(digest, field)
+			if err != nil {
+				return err
+			}
 		}
 
 		req.SessionID = strconv.FormatUint(digest.Sum64(), 10)
@@ -166,10 +218,30 @@ func (s *Base) Parse(username []byte, req *pkg.Request) (err error) {
 
 	req.Routes = make([]pkg.Route, 0, 6)
 
+	if req.Continent != nil {
+		req.Routes = append(req.Routes, pkg.RouteContinent)
+	}
+
 	if req.Country != nil {
 		req.Routes = append(req.Routes, pkg.RouteCountry)
 	}
 
+	if req.Region != nil {
+		req.Routes = append(req.Routes, pkg.RouteRegion)
+	}
+
+	if req.City != nil {
+		req.Routes = append(req.Routes, pkg.RouteCity)
+	}
+
+	if req.Zip != nil {
+		req.Routes = append(req.Routes, pkg.RouteZip)
+	}
+
+	if req.ASN != 0 {
+		req.Routes = append(req.Routes, pkg.RouteASN)
+	}
+
 	req.Features = make([]pkg.Feature, 0, 2)
 	if req.SessionID != "" {
 		req.Features = append(req.Features, pkg.Sticky)
@@ -185,3 +257,49 @@ func (s *Base) Parse(username []byte, req *pkg.Request) (err error) {
 
 	return
 }
+
+// writeField - length prefixed field, so adjacent fields can not run into each other
+func writeField(digest *xxhash.Digest, field []byte) error {
+	var size [binary.MaxVarintLen64]byte
+	_, err := digest.Write(size[:binary.PutUvarint(size[:], uint64(len(field)))])
+	if err != nil {
+		return err
+	}
+
+	_, err = digest.Write(field)
+	return err
+}
+
+// validateLocation - check the continent and the region exist and agree with the targeted country
+func (s *Base) validateLocation(req *pkg.Request) error {
+	if req.Continent != nil {
+		continent, ok := continents[zerocopy.String(req.Continent)]
+		if !ok {
+			return ErrInvalidContinent
+		}
+
+		if req.Country != nil {
+			country, err := s.location.FindCountryByAlpha(zerocopy.String(req.Country))
+			if err == nil && !strings.EqualFold(country.Geo.Continent, continent) {
+				return ErrInvalidContinent
+			}
+		}
+	}
+
+	// regions are validated against the subdivisions of the country, by ISO code or by name
+	if req.Region != nil && req.Country != nil {
+		country, err := s.location.FindCountryByAlpha(zerocopy.String(req.Country))
+		if err != nil {
+			return ErrInvalidCountry
+		}
+
+		region := zerocopy.String(req.Region)
+		if _, err = country.FindSubdivisionByCode(region); err != nil {
+			if _, err = country.FindSubdivisionByName(strings.ReplaceAll(region, "_", " ")); err != nil {
+				return ErrInvalidRegion
+			}
+		}
+	}
+
+	return nil
+}
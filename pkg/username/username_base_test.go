@@ -0,0 +1,190 @@
+package username
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/omimic12/proxy-server/pkg"
+	"github.com/pariz/gountries"
+)
+
+var location = gountries.New()
+
+func TestParseTargeting(t *testing.T) {
+	tests := []struct {
+		name     string
+		username string
+		want     pkg.Request
+		err      error
+	}{
+		{
+			name:     "country",
+			username: "profile-residential-rotating-1-country-us",
+			want:     pkg.Request{Country: []byte("us")},
+		},
+		{
+			name:     "uk is gb",
+			username: "profile-residential-rotating-1-country-uk",
+			want:     pkg.Request{Country: []byte("gb")},
+		},
+		{
+			name:     "continent is lowercased",
+			username: "profile-residential-rotating-1-continent-EU",
+			want:     pkg.Request{Continent: []byte("eu")},
+		},
+		{
+			name:     "continent of the country",
+			username: "profile-residential-rotating-1-continent-na-country-us",
+			want:     pkg.Request{Continent: []byte("na"), Country: []byte("us")},
+		},
+		{
+			name:     "unknown continent",
+			username: "profile-residential-rotating-1-continent-xx",
+			err:      ErrInvalidContinent,
+		},
+		{
+			name:     "continent not of the country",
+			username: "profile-residential-rotating-1-continent-eu-country-us",
+			err:      ErrInvalidContinent,
+		},
+		{
+			name:     "state by code",
+			username: "profile-residential-rotating-1-country-us-state-CA",
+			want:     pkg.Request{Country: []byte("us"), Region: []byte("CA")},
+		},
+		{
+			name:     "region by name",
+			username: "profile-residential-rotating-1-country-us-region-new_york",
+			want:     pkg.Request{Country: []byte("us"), Region: []byte("new_york")},
+		},
+		{
+			name:     "unknown state",
+			username: "profile-residential-rotating-1-country-us-state-zz",
+			err:      ErrInvalidRegion,
+		},
+		{
+			name:     "city and zip",
+			username: "profile-residential-rotating-1-country-us-city-los_angeles-zip-90001",
+			want:     pkg.Request{Country: []byte("us"), City: []byte("los_angeles"), Zip: []byte("90001")},
+		},
+		{
+			name:     "asn",
+			username: "profile-residential-rotating-1-asn-7922",
+			want:     pkg.Request{ASN: 7922},
+		},
+		{
+			name:     "asn with prefix",
+			username: "profile-residential-rotating-1-asn-AS7922",
+			want:     pkg.Request{ASN: 7922},
+		},
+		{
+			name:     "asn zero",
+			username: "profile-residential-rotating-1-asn-0",
+			err:      ErrInvalidASN,
+		},
+		{
+			name:     "asn not a number",
+			username: "profile-residential-rotating-1-asn-comcast",
+			err:      ErrInvalidASN,
+		},
+		{
+			name:     "isp",
+			username: "profile-residential-rotating-1-country-us-isp-comcast_cable",
+			want:     pkg.Request{Country: []byte("us"), ISP: []byte("comcast_cable")},
+		},
+	}
+
+	parser := NewBaseUsername(time.Minute, time.Hour, location)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var req pkg.Request
+			err := parser.Parse([]byte(tt.username), &req)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Parse() error = %v, want %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+
+			got := map[string]string{
+				"continent": string(req.Continent), "country": string(req.Country), "region": string(req.Region),
+				"city": string(req.City), "zip": string(req.Zip), "isp": string(req.ISP),
+			}
+			want := map[string]string{
+				"continent": string(tt.want.Continent), "country": string(tt.want.Country), "region": string(tt.want.Region),
+				"city": string(tt.want.City), "zip": string(tt.want.Zip), "isp": string(tt.want.ISP),
+			}
+			for field := range want {
+				if got[field] != want[field] {
+					t.Errorf("%s = %q, want %q", field, got[field], want[field])
+				}
+			}
+			if req.ASN != tt.want.ASN {
+				t.Errorf("asn = %d, want %d", req.ASN, tt.want.ASN)
+			}
+		})
+	}
+}
+
+func TestValidateLocation(t *testing.T) {
+	tests := []struct {
+		name    string
+		request pkg.Request
+		err     error
+	}{
+		{name: "no targeting"},
+		{name: "continent", request: pkg.Request{Continent: []byte("as")}},
+		{name: "unknown continent", request: pkg.Request{Continent: []byte("europe")}, err: ErrInvalidContinent},
+		{name: "continent of the country", request: pkg.Request{Continent: []byte("eu"), Country: []byte("de")}},
+		{name: "continent not of the country", request: pkg.Request{Continent: []byte("as"), Country: []byte("de")}, err: ErrInvalidContinent},
+		{name: "region without country is left to the providers", request: pkg.Request{Region: []byte("anything")}},
+		{name: "region by code", request: pkg.Request{Country: []byte("us"), Region: []byte("TX")}},
+		{name: "region by name", request: pkg.Request{Country: []byte("us"), Region: []byte("north_carolina")}},
+		{name: "region of another country", request: pkg.Request{Country: []byte("de"), Region: []byte("TX")}, err: ErrInvalidRegion},
+		{name: "region of an unknown country", request: pkg.Request{Country: []byte("zz"), Region: []byte("TX")}, err: ErrInvalidCountry},
+	}
+
+	parser := NewBaseUsername(time.Minute, time.Hour, location)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := parser.validateLocation(&tt.request); !errors.Is(err, tt.err) {
+				t.Errorf("validateLocation() error = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestParseSessionID(t *testing.T) {
+	sessionID := func(username string) string {
+		t.Helper()
+
+		req := pkg.Request{Password: "secret"}
+		if err := NewBaseUsername(time.Minute, time.Hour, location).Parse([]byte(username), &req); err != nil {
+			t.Fatalf("Parse(%s) error = %v", username, err)
+		}
+		return req.SessionID
+	}
+
+	base := sessionID("profile-residential-sticky-1-country-us-city-ab-zip-c-session-1")
+	if again := sessionID("profile-residential-sticky-1-country-us-city-ab-zip-c-session-1"); again != base {
+		t.Errorf("same targeting session = %s, want %s", again, base)
+	}
+
+	tests := []struct {
+		name     string
+		username string
+	}{
+		{name: "targeting shifted between fields", username: "profile-residential-sticky-1-country-us-city-a-zip-bc-session-1"},
+		{name: "other session", username: "profile-residential-sticky-1-country-us-city-ab-zip-c-session-2"},
+		{name: "other isp", username: "profile-residential-sticky-1-country-us-city-ab-zip-c-isp-x-session-1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if id := sessionID(tt.username); id == base {
+				t.Errorf("session = %s, want a session other than %s", id, base)
+			}
+		})
+	}
+}